@@ -129,7 +129,9 @@ func connectEU() (driver.Conn, error) {
 	return conn, nil
 }
 
-func connectUS() (driver.Conn, error) {
+// connectUS connects to the US cluster with a pool of maxOpenConns
+// connections, 0 keeps the driver's default
+func connectUS(maxOpenConns int) (driver.Conn, error) {
 	addr := fmt.Sprintf("%s:%d", viper.GetString("CLICKHOUSE_US_HOSTNAME"), viper.GetInt("CLICKHOUSE_US_PORT"))
 	var (
 		ctx       = context.Background()
@@ -148,7 +150,9 @@ func connectUS() (driver.Conn, error) {
 					{Name: "an-example-go-client", Version: "0.1"},
 				},
 			},
-			ReadTimeout: 300 * time.Minute,
+			ReadTimeout:  300 * time.Minute,
+			MaxOpenConns: maxOpenConns,
+			MaxIdleConns: maxOpenConns,
 			Debugf: func(format string, v ...interface{}) {
 				fmt.Printf(format, v)
 			},
@@ -2,111 +2,361 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
-func moveTo(ctx context.Context, conn driver.Conn, database, table, fromDisk, toDisk string) error {
-	fmt.Printf("Moving parts for table: %s.%s from disk %s to disk %s\n", database, table, fromDisk, toDisk)
+// movePollInterval is how often the progress of running moves is printed
+const movePollInterval = 2 * time.Second
+
+// moveRetryBackoff is the wait before retrying a failed move, doubled after
+// every attempt up to maxMoveRetryBackoff
+const (
+	moveRetryBackoff    = 5 * time.Second
+	maxMoveRetryBackoff = time.Minute
+)
+
+const (
+	// reservedMoveConns are the connections used besides the movers' ones,
+	// by the system.moves poller and the free space checks
+	reservedMoveConns = 2
+	// maxDefaultMovers bounds the movers a connection pool is opened for
+	// when the parallelism defaults to background_move_pool_size
+	maxDefaultMovers = 32
+)
+
+// MoveOptions configures how parts are moved between disks
+type MoveOptions struct {
+	// Parallel is the number of parts moved at once, across tables when
+	// draining a disk. It is capped by the server's background_move_pool_size
+	// since moves beyond it would only queue, 0 uses the pool size.
+	Parallel int
+	// DryRun prints the plan of the moves instead of moving anything
+	DryRun bool
+	// Headroom is the fraction of the target disk's total space that must
+	// stay free, moves that would eat into it don't start
+	Headroom float64
+	// StateFile is where drain-disk records the moved and failed parts, so
+	// that an interrupted drain can be resumed
+	StateFile string
+	// Resume continues the drain recorded in StateFile, skipping the tables
+	// and parts already moved
+	Resume bool
+	// MaxAttempts bounds how many times a failing part is moved, over all the
+	// runs of a drain
+	MaxAttempts int
+	// MaxBytesPerSec paces the start of moves so that on average no more
+	// bytes_on_disk than this are moved per second, 0 doesn't limit them
+	MaxBytesPerSec uint64
+	// MaxOpenConns is the size of the connection pool the moves share, the
+	// movers are capped so that the poller and free space checks always get
+	// a connection. 0 doesn't cap them.
+	MaxOpenConns int
+	// PauseWindows are times of day, as HH:MM-HH:MM in the local time zone,
+	// during which no moves start
+	PauseWindows []string
+}
+
+// diskPart is an active part on the disk being moved from
+type diskPart struct {
+	database string
+	table    string
+	name     string
+	bytes    uint64
+}
+
+// quoteString quotes s as a ClickHouse string literal
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+// movePartQuery builds the ALTER moving a part, ALTER TABLE doesn't take
+// query parameters for the part and disk
+func movePartQuery(part diskPart, toDisk string) string {
+	return fmt.Sprintf("ALTER TABLE `%s`.`%s` MOVE PART %s TO DISK %s",
+		strings.ReplaceAll(part.database, "`", "\\`"), strings.ReplaceAll(part.table, "`", "\\`"),
+		quoteString(part.name), quoteString(toDisk))
+}
+
+// backgroundMovePoolSize reads the number of threads the server moves parts
+// with, from system.server_settings or, on versions before it existed,
+// system.settings
+func backgroundMovePoolSize(ctx context.Context, conn driver.Conn) (int, error) {
+	var lastErr error
+	for _, table := range []string{"system.server_settings", "system.settings"} {
+		var value string
+		err := conn.QueryRow(ctx, "select value from "+table+" where name = 'background_move_pool_size'").Scan(&value)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return 0, fmt.Errorf("parsing background_move_pool_size %q: %v", value, err)
+		}
+		return size, nil
+	}
+	return 0, fmt.Errorf("reading background_move_pool_size: %v", lastErr)
+}
+
+// moveConnections is the connection pool size moving parallel parts at
+// once needs
+func moveConnections(parallel int) int {
+	if parallel <= 0 || parallel > maxDefaultMovers {
+		parallel = maxDefaultMovers
+	}
+	return parallel + reservedMoveConns
+}
+
+// effectiveParallel caps the requested parallelism at the move pool size
+func effectiveParallel(requested, poolSize int) int {
+	if poolSize <= 0 {
+		return max(requested, 1)
+	}
+	if requested <= 0 || requested > poolSize {
+		return poolSize
+	}
+	return requested
+}
+
+func listParts(ctx context.Context, conn driver.Conn, fromDisk, database, table string) ([]diskPart, error) {
 	rows, err := conn.Query(
 		ctx,
-		"select name from system.parts where active and disk_name = {fromDisk:String} and database = {database:String} and table = {table:String} group by name;",
+		"select database, table, name, any(bytes_on_disk) from system.parts where active and disk_name = {fromDisk:String} and database = {database:String} and table = {table:String} group by database, table, name order by name;",
 		clickhouse.Named("fromDisk", fromDisk),
 		clickhouse.Named("database", database),
 		clickhouse.Named("table", table))
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return nil, fmt.Errorf("listing parts of %s.%s: %v", database, table, err)
 	}
+	defer rows.Close()
+	var parts []diskPart
 	for rows.Next() {
-		var name string
+		var part diskPart
 		if err := rows.Scan(
-			&name,
+			&part.database,
+			&part.table,
+			&part.name,
+			&part.bytes,
 		); err != nil {
-			log.Fatal(err)
-			return err
+			return nil, fmt.Errorf("listing parts of %s.%s: %v", database, table, err)
 		}
-		fmt.Printf("Moving part: %s for table %s.%s to disk %s\n", name, database, table, toDisk)
-		fmtQuery := fmt.Sprintf("ALTER TABLE {database:Identifier}.{table:Identifier} move part '%s' to disk '%s'", name, toDisk)
-
-		done := make(chan bool)
-		go func() {
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
 
-			pollconn, err := connectUS()
-			if err != nil {
-				panic(err)
+// pollMoves prints the moves running on the server until ctx is cancelled,
+// a single poller serves all the parts being moved at once
+func pollMoves(ctx context.Context, conn driver.Conn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(movePollInterval):
+		}
+		rows, err := conn.Query(
+			ctx,
+			"select database, table, elapsed, target_disk_name, target_disk_path, part_name, part_size, thread_id from system.moves",
+		)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("polling system.moves:", err)
 			}
-			defer pollconn.Close()
-			for {
-				select {
-				case <-done:
-					return
-				default:
-					rows, err := pollconn.Query(
-						ctx,
-						"select database, table, elapsed, target_disk_name, target_disk_path, part_name, part_size, thread_id from system.moves",
-					)
-					if err != nil {
-						log.Fatal(err)
-					}
-					for rows.Next() {
-						var (
-							database       string
-							table          string
-							elapsed        float64
-							targetDiskName string
-							targetDiskPath string
-							partName       string
-							partSize       uint64
-							threadID       uint64
-						)
-						if err := rows.Scan(
-							&database,
-							&table,
-							&elapsed,
-							&targetDiskName,
-							&targetDiskPath,
-							&partName,
-							&partSize,
-							&threadID,
-						); err != nil {
-							log.Fatal(err)
-						}
-						fmt.Printf("Moving part %s for table %s.%s to disk %s (%s) [elapsed: %f, size: %d, thread: %d]\n", partName, database, table, targetDiskName, targetDiskPath, elapsed, partSize, threadID)
-					}
-					time.Sleep(2 * time.Second)
+			continue
+		}
+		for rows.Next() {
+			var (
+				database       string
+				table          string
+				elapsed        float64
+				targetDiskName string
+				targetDiskPath string
+				partName       string
+				partSize       uint64
+				threadID       uint64
+			)
+			if err := rows.Scan(
+				&database,
+				&table,
+				&elapsed,
+				&targetDiskName,
+				&targetDiskPath,
+				&partName,
+				&partSize,
+				&threadID,
+			); err != nil {
+				log.Println("polling system.moves:", err)
+				break
+			}
+			fmt.Printf("Moving part %s for table %s.%s to disk %s (%s) [elapsed: %f, size: %d, thread: %d]\n", partName, database, table, targetDiskName, targetDiskPath, elapsed, partSize, threadID)
+		}
+		rows.Close()
+	}
+}
+
+// moveParts moves parts to toDisk, opts.Parallel at a time. A part that
+// fails to move doesn't stop the others, the failures are returned together.
+// Dispatching stops when guard runs out of room on the target disk and waits
+// for throttle between parts. When
+// state isn't nil, failed parts are retried up to opts.MaxAttempts and every
+// outcome is recorded in it.
+func moveParts(ctx context.Context, conn driver.Conn, parts []diskPart, toDisk string, opts MoveOptions, guard *spaceGuard, throttle *moveThrottle, state *drainState) error {
+	poolSize, err := backgroundMovePoolSize(ctx, conn)
+	if err != nil {
+		log.Println(err)
+	}
+	parallel := effectiveParallel(opts.Parallel, poolSize)
+	if opts.Parallel > parallel {
+		fmt.Printf("Moving %d parts at once instead of %d, the server's background_move_pool_size is %d\n", parallel, opts.Parallel, poolSize)
+	}
+	// movers waiting on a full connection pool would fail with acquire conn timeout
+	if movers := opts.MaxOpenConns - reservedMoveConns; opts.MaxOpenConns > 0 && parallel > movers {
+		fmt.Printf("Moving %d parts at once instead of %d, the connection pool has %d connections\n", movers, parallel, opts.MaxOpenConns)
+		parallel = movers
+	}
+
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	defer stopPolling()
+	go pollMoves(pollCtx, conn)
+
+	var (
+		work = make(chan diskPart)
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range work {
+				err := movePart(ctx, conn, part, toDisk, opts.MaxAttempts, state)
+				guard.release(part.bytes)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
 				}
 			}
 		}()
-		err = conn.Exec(
-			ctx,
-			fmtQuery,
-			clickhouse.Named("database", database),
-			clickhouse.Named("table", table),
-			clickhouse.Named("part_name", name))
-		if err != nil {
-			log.Fatal(err)
-			done <- true
+	}
+dispatch:
+	for _, part := range parts {
+		if err := throttle.wait(ctx, part.bytes); err != nil {
+			break
+		}
+		if err := guard.reserve(ctx, part.bytes); err != nil {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+			break
+		}
+		select {
+		case work <- part:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(work)
+	wg.Wait()
+	if ctx.Err() != nil {
+		errs = append(errs, ctx.Err())
+	}
+	return errors.Join(errs...)
+}
+
+// movePart moves a part, retrying it while state allows more attempts
+func movePart(ctx context.Context, conn driver.Conn, part diskPart, toDisk string, maxAttempts int, state *drainState) error {
+	for {
+		fmt.Printf("Moving part: %s for table %s.%s to disk %s\n", part.name, part.database, part.table, toDisk)
+		err := conn.Exec(ctx, movePartQuery(part, toDisk))
+		if err == nil {
+			// the part did move, a failed periodic save is retried by the
+			// next one and the final save fails the drain if it persists
+			if saveErr := state.markMoved(part); saveErr != nil {
+				log.Println(saveErr)
+			}
+			return nil
+		}
+		err = fmt.Errorf("moving part %s of %s.%s: %v", part.name, part.database, part.table, err)
+		log.Println(err)
+		if ctx.Err() != nil {
+			// an interrupted move isn't the part's fault, it's retried on resume
+			return err
+		}
+		if saveErr := state.markFailed(part, err); saveErr != nil {
+			log.Println(saveErr)
+		}
+		attempts := state.attempts(part)
+		if state == nil || attempts >= maxAttempts {
+			return err
+		}
+		if err := sleepContext(ctx, retryBackoff(attempts)); err != nil {
 			return err
 		}
-		done <- true
 	}
-	return nil
 }
 
-func drainDisk(ctx context.Context, conn driver.Conn, disk, toDisk string) error {
+// retryBackoff is the wait before retrying a part that failed attempts times
+func retryBackoff(attempts int) time.Duration {
+	backoff := moveRetryBackoff
+	for i := 1; i < attempts && backoff < maxMoveRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxMoveRetryBackoff)
+}
+
+func moveTo(ctx context.Context, conn driver.Conn, database, table, fromDisk, toDisk string, opts MoveOptions) error {
+	fmt.Printf("Moving parts for table: %s.%s from disk %s to disk %s\n", database, table, fromDisk, toDisk)
+	parts, err := listParts(ctx, conn, fromDisk, database, table)
+	if err != nil {
+		return err
+	}
+	return runMoves(ctx, conn, parts, toDisk, opts, nil)
+}
+
+// drainDisk moves every part on disk to toDisk. Progress is recorded in
+// opts.StateFile, with opts.Resume the tables and parts an earlier run moved
+// are skipped. A report of what is left on disk ends the drain, the state
+// file is removed when nothing is left and no part failed.
+func drainDisk(ctx context.Context, conn driver.Conn, disk, toDisk string, opts MoveOptions) error {
+	if opts.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1, got %d", opts.MaxAttempts)
+	}
+	state := newDrainState(opts.StateFile, disk, toDisk)
+	if opts.Resume {
+		var err error
+		if state, err = loadDrainState(opts.StateFile, disk, toDisk); err != nil {
+			return err
+		}
+		fmt.Printf("Resuming the drain started %s, %d tables already drained\n", state.started.Format(time.RFC3339), len(state.completed))
+	} else if !opts.DryRun {
+		if err := checkNoDrainState(opts.StateFile); err != nil {
+			return err
+		}
+	}
+
 	fmt.Printf("Draining disk: %s\n", disk)
 	query := "select database, table, disk_name, sum(bytes) b, formatReadableSize(sum(bytes)) size, count(1) parts " +
 		"from system.parts where disk_name = {disk_name:String} group by database, table, disk_name order by disk_name desc;"
 	rows, err := conn.Query(ctx, query, clickhouse.Named("disk_name", disk))
 	if err != nil {
-		log.Fatal(err)
 		return err
 	}
+	defer rows.Close()
+	var tables []tableKey
 	for rows.Next() {
 		var (
 			database string
@@ -124,15 +374,117 @@ func drainDisk(ctx context.Context, conn driver.Conn, disk, toDisk string) error
 			&size,
 			&parts,
 		); err != nil {
-			log.Fatal(err)
 			return err
 		}
+		if state.tableCompleted(tableKey{database, table}.String()) {
+			fmt.Printf("Skipping Table: %s.%s, drained by an earlier run\n", database, table)
+			continue
+		}
 		fmt.Printf("Moving Table: %s.%s, Disk: %s, Parts: %d, Size: %s To Disk: %s\n", database, table, diskName, parts, size, toDisk)
-		err := moveTo(ctx, conn, database, table, disk, toDisk)
+		tables = append(tables, tableKey{database, table})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the parts of all tables share the same movers so tables are drained in parallel too
+	var parts []diskPart
+	for _, t := range tables {
+		tableParts, err := listParts(ctx, conn, disk, t.database, t.table)
 		if err != nil {
-			log.Fatal(err)
 			return err
 		}
+		parts = append(parts, tableParts...)
+	}
+	pending := state.pendingParts(parts, opts.MaxAttempts)
+	if skipped := len(parts) - len(pending); skipped > 0 {
+		fmt.Printf("Skipping %d parts moved by an earlier run or failed %d times\n", skipped, opts.MaxAttempts)
+	}
+	if opts.DryRun {
+		return runMoves(ctx, conn, interleaveTables(pending), toDisk, opts, nil)
+	}
+
+	moveErr := runMoves(ctx, conn, interleaveTables(pending), toDisk, opts, state)
+	// the report runs even when the drain was interrupted
+	reportCtx := context.WithoutCancel(ctx)
+	if err := state.completeTables(parts, tables); err != nil {
+		return errors.Join(moveErr, err)
+	}
+	leftovers, err := leftoverParts(reportCtx, conn, disk)
+	if err != nil {
+		return errors.Join(moveErr, err)
+	}
+	printDrainReport(os.Stdout, state, leftovers, opts.MaxAttempts)
+	if moveErr == nil && state.finished(leftovers) {
+		// nothing is left to resume, the next drain starts fresh
+		if err := state.remove(); err != nil {
+			return err
+		}
+		fmt.Printf("Removed drain state %s\n", opts.StateFile)
+	}
+	return moveErr
+}
+
+// runMoves moves parts once the preflight checks passed or, in a dry run,
+// only prints what moving them would do
+func runMoves(ctx context.Context, conn driver.Conn, parts []diskPart, toDisk string, opts MoveOptions, state *drainState) error {
+	if opts.Headroom < 0 || opts.Headroom >= 1 {
+		return fmt.Errorf("headroom must be a fraction between 0 and 1, got %v", opts.Headroom)
+	}
+	windows, err := parsePauseWindows(opts.PauseWindows)
+	if err != nil {
+		return err
+	}
+	throttle := newMoveThrottle(opts.MaxBytesPerSec, windows)
+	plan, err := planMoves(ctx, conn, parts, toDisk)
+	if err != nil {
+		return err
+	}
+	space, err := readDiskSpace(ctx, conn, toDisk)
+	if err != nil {
+		return err
+	}
+	checkErr := preflight(plan, space, opts.Headroom)
+	if opts.DryRun {
+		printPlan(os.Stdout, plan)
+		if checkErr != nil {
+			fmt.Printf("\n%v\n", checkErr)
+		} else {
+			fmt.Printf("\nPreflight passed: %s of the %s available on disk %s\n", formatBytes(plan.bytes), formatBytes(space.available(opts.Headroom)), toDisk)
+		}
+		printThrottle(os.Stdout, throttle, plan.bytes)
+		return nil
+	}
+	if checkErr != nil {
+		return checkErr
+	}
+	printThrottle(os.Stdout, throttle, plan.bytes)
+	return moveParts(ctx, conn, parts, toDisk, opts, newSpaceGuard(conn, space, opts.Headroom), throttle, state)
+}
+
+// interleaveTables orders parts round-robin across tables, so that moving
+// parts in order spreads the moves over all tables instead of draining one
+// table after the other
+func interleaveTables(parts []diskPart) []diskPart {
+	var (
+		order   []string
+		byTable = make(map[string][]diskPart)
+	)
+	for _, part := range parts {
+		key := part.database + "." + part.table
+		if _, ok := byTable[key]; !ok {
+			order = append(order, key)
+		}
+		byTable[key] = append(byTable[key], part)
+	}
+	interleaved := make([]diskPart, 0, len(parts))
+	for len(interleaved) < len(parts) {
+		for _, key := range order {
+			if tableParts := byTable[key]; len(tableParts) > 0 {
+				interleaved = append(interleaved, tableParts[0])
+				byTable[key] = tableParts[1:]
+			}
+		}
 	}
-	return nil
+	return interleaved
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// tableKey identifies a table on the server
+type tableKey struct {
+	database string
+	table    string
+}
+
+func (k tableKey) String() string {
+	return k.database + "." + k.table
+}
+
+// tablePlan totals the parts of a table a move would touch
+type tablePlan struct {
+	tableKey
+	storagePolicy string
+	parts         int
+	bytes         uint64
+	// policyHasDisk reports whether the table's storage policy contains the
+	// target disk, moves to a disk outside of it fail
+	policyHasDisk bool
+}
+
+// movePlan is what moving parts to toDisk would do
+type movePlan struct {
+	toDisk string
+	parts  []diskPart
+	tables []tablePlan
+	bytes  uint64
+}
+
+// unmovableTables lists the tables whose storage policy lacks the target disk
+func (p movePlan) unmovableTables() []tablePlan {
+	var tables []tablePlan
+	for _, t := range p.tables {
+		if !t.policyHasDisk {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// buildPlan totals parts per table. policies maps tables to their storage
+// policy and policyDisks storage policies to their disks.
+func buildPlan(parts []diskPart, toDisk string, policies map[tableKey]string, policyDisks map[string][]string) movePlan {
+	plan := movePlan{toDisk: toDisk, parts: parts}
+	index := make(map[tableKey]int)
+	for _, part := range parts {
+		key := tableKey{part.database, part.table}
+		i, ok := index[key]
+		if !ok {
+			policy := policies[key]
+			i = len(plan.tables)
+			index[key] = i
+			plan.tables = append(plan.tables, tablePlan{
+				tableKey:      key,
+				storagePolicy: policy,
+				policyHasDisk: includes(policyDisks[policy], toDisk),
+			})
+		}
+		plan.tables[i].parts++
+		plan.tables[i].bytes += part.bytes
+		plan.bytes += part.bytes
+	}
+	return plan
+}
+
+// storagePolicies reads the storage policy of the tables and the disks of
+// every storage policy
+func storagePolicies(ctx context.Context, conn driver.Conn, tables []tableKey) (map[tableKey]string, map[string][]string, error) {
+	policies := make(map[tableKey]string)
+	for _, t := range tables {
+		var policy string
+		err := conn.QueryRow(ctx,
+			"select storage_policy from system.tables where database = {database:String} and name = {table:String}",
+			clickhouse.Named("database", t.database),
+			clickhouse.Named("table", t.table)).Scan(&policy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading storage policy of %s: %v", t, err)
+		}
+		policies[t] = policy
+	}
+
+	rows, err := conn.Query(ctx, "select policy_name, groupArrayArray(disks) from system.storage_policies group by policy_name")
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading storage policies: %v", err)
+	}
+	defer rows.Close()
+	policyDisks := make(map[string][]string)
+	for rows.Next() {
+		var (
+			policy string
+			disks  []string
+		)
+		if err := rows.Scan(&policy, &disks); err != nil {
+			return nil, nil, fmt.Errorf("reading storage policies: %v", err)
+		}
+		policyDisks[policy] = disks
+	}
+	return policies, policyDisks, rows.Err()
+}
+
+// planMoves plans moving parts to toDisk without moving anything
+func planMoves(ctx context.Context, conn driver.Conn, parts []diskPart, toDisk string) (movePlan, error) {
+	var (
+		tables []tableKey
+		seen   = make(map[tableKey]bool)
+	)
+	for _, part := range parts {
+		key := tableKey{part.database, part.table}
+		if !seen[key] {
+			seen[key] = true
+			tables = append(tables, key)
+		}
+	}
+	policies, policyDisks, err := storagePolicies(ctx, conn, tables)
+	if err != nil {
+		return movePlan{}, err
+	}
+	return buildPlan(parts, toDisk, policies, policyDisks), nil
+}
+
+func printPlan(w io.Writer, plan movePlan) {
+	fmt.Fprintf(w, "\nPlan: move %d parts (%s) of %d tables to disk %s\n", len(plan.parts), formatBytes(plan.bytes), len(plan.tables), plan.toDisk)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "table\tpart\tsize\ttarget disk")
+	for _, part := range plan.parts {
+		fmt.Fprintf(tw, "%s.%s\t%s\t%s\t%s\n", part.database, part.table, part.name, formatBytes(part.bytes), plan.toDisk)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nPer table:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "table\tparts\tsize\tstorage policy\ttarget disk in policy")
+	for _, t := range plan.tables {
+		inPolicy := "yes"
+		if !t.policyHasDisk {
+			inPolicy = "NO"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", t.tableKey, t.parts, formatBytes(t.bytes), t.storagePolicy, inPolicy)
+	}
+	tw.Flush()
+
+	if unmovable := plan.unmovableTables(); len(unmovable) > 0 {
+		fmt.Fprintf(w, "\n%d tables can't be moved, disk %s isn't in their storage policy:\n", len(unmovable), plan.toDisk)
+		for _, t := range unmovable {
+			fmt.Fprintf(w, "  %s (policy %s)\n", t.tableKey, t.storagePolicy)
+		}
+	}
+}
+
+// formatBytes formats a size like formatReadableSize
+func formatBytes(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.2f %s", size, units[unit])
+}
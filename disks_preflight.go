@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// spaceCheckInterval is how often the free space of the target disk is
+// read again while parts are being moved
+const spaceCheckInterval = 10 * time.Second
+
+// diskSpace is the capacity of a disk as reported by system.disks
+type diskSpace struct {
+	name          string
+	freeSpace     uint64
+	totalSpace    uint64
+	keepFreeSpace uint64
+}
+
+// available is the space moves may fill while leaving keep_free_space and
+// a headroom fraction of the disk free
+func (d diskSpace) available(headroom float64) uint64 {
+	reserved := d.keepFreeSpace + uint64(headroom*float64(d.totalSpace))
+	if d.freeSpace <= reserved {
+		return 0
+	}
+	return d.freeSpace - reserved
+}
+
+func readDiskSpace(ctx context.Context, conn driver.Conn, disk string) (diskSpace, error) {
+	space := diskSpace{name: disk}
+	err := conn.QueryRow(ctx,
+		"select free_space, total_space, keep_free_space from system.disks where name = {disk:String}",
+		clickhouse.Named("disk", disk)).Scan(&space.freeSpace, &space.totalSpace, &space.keepFreeSpace)
+	if err != nil {
+		return space, fmt.Errorf("reading free space of disk %s: %v", disk, err)
+	}
+	return space, nil
+}
+
+// preflight checks that every table of the plan can be moved to the target
+// disk and that the disk has room for all of it
+func preflight(plan movePlan, space diskSpace, headroom float64) error {
+	var problems []string
+	if unmovable := plan.unmovableTables(); len(unmovable) > 0 {
+		names := make([]string, 0, len(unmovable))
+		for _, t := range unmovable {
+			names = append(names, fmt.Sprintf("%s (policy %s)", t.tableKey, t.storagePolicy))
+		}
+		problems = append(problems, fmt.Sprintf("disk %s isn't in the storage policy of %s", plan.toDisk, strings.Join(names, ", ")))
+	}
+	if available := space.available(headroom); plan.bytes > available {
+		problems = append(problems, fmt.Sprintf("moving %s to disk %s needs more than the %s available while keeping %.0f%% of it free (free %s, keep_free_space %s)",
+			formatBytes(plan.bytes), space.name, formatBytes(available), headroom*100, formatBytes(space.freeSpace), formatBytes(space.keepFreeSpace)))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("preflight failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// spaceGuard stops moves before they fill the target disk beyond the
+// headroom, in case something else writes to it while the parts are moved
+type spaceGuard struct {
+	conn     driver.Conn
+	disk     string
+	headroom float64
+
+	mu        sync.Mutex
+	checked   time.Time
+	available uint64
+	inFlight  uint64
+}
+
+func newSpaceGuard(conn driver.Conn, space diskSpace, headroom float64) *spaceGuard {
+	return &spaceGuard{
+		conn:      conn,
+		disk:      space.name,
+		headroom:  headroom,
+		checked:   time.Now(),
+		available: space.available(headroom),
+	}
+}
+
+// reserve claims room for a part about to be moved, re-reading the free
+// space of the disk when the last reading is stale
+func (g *spaceGuard) reserve(ctx context.Context, bytes uint64) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.checked) >= spaceCheckInterval {
+		space, err := readDiskSpace(ctx, g.conn, g.disk)
+		if err != nil {
+			return err
+		}
+		g.checked = time.Now()
+		// parts still being moved aren't part of the free space yet
+		g.available = max(space.available(g.headroom), g.inFlight) - g.inFlight
+	}
+	if bytes > g.available {
+		return fmt.Errorf("stopping early, disk %s has %s left before reaching the headroom and the next part is %s",
+			g.disk, formatBytes(g.available), formatBytes(bytes))
+	}
+	g.available -= bytes
+	g.inFlight += bytes
+	return nil
+}
+
+// release marks a reserved part as no longer in flight
+func (g *spaceGuard) release(bytes uint64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inFlight -= bytes
+}
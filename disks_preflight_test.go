@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskSpaceAvailable(t *testing.T) {
+	space := diskSpace{name: "cold", freeSpace: 500, totalSpace: 1000, keepFreeSpace: 50}
+	assert.Equal(t, uint64(450), space.available(0))
+	assert.Equal(t, uint64(350), space.available(0.1))
+	assert.Equal(t, uint64(0), space.available(0.5))
+}
+
+func TestPreflight(t *testing.T) {
+	space := diskSpace{name: "cold", freeSpace: 500, totalSpace: 1000, keepFreeSpace: 50}
+	fits := movePlan{
+		toDisk: "cold",
+		bytes:  300,
+		tables: []tablePlan{{tableKey: tableKey{"db", "events"}, storagePolicy: "tiered", policyHasDisk: true}},
+	}
+	assert.NoError(t, preflight(fits, space, 0.1))
+
+	tooBig := fits
+	tooBig.bytes = 400
+	err := preflight(tooBig, space, 0.1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs more than the 350.00 B available while keeping 10% of it free")
+
+	wrongPolicy := fits
+	wrongPolicy.tables = append(wrongPolicy.tables, tablePlan{tableKey: tableKey{"db", "persons"}, storagePolicy: "default"})
+	err = preflight(wrongPolicy, space, 0.1)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "disk cold isn't in the storage policy of db.persons (policy default)")
+}
+
+func TestSpaceGuard(t *testing.T) {
+	ctx := context.Background()
+	guard := newSpaceGuard(nil, diskSpace{name: "cold", freeSpace: 500, totalSpace: 1000}, 0.1)
+	require.NoError(t, guard.reserve(ctx, 250))
+	require.NoError(t, guard.reserve(ctx, 150))
+	assert.Error(t, guard.reserve(ctx, 100))
+	guard.release(250)
+	assert.Equal(t, uint64(150), guard.inFlight)
+
+	// a nil guard never stops moves
+	var none *spaceGuard
+	assert.NoError(t, none.reserve(ctx, 1<<50))
+	none.release(1 << 50)
+}
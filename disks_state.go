@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// drainStateSaveInterval is how often the drain state is written while
+// parts are moved. Parts moved since the last save are off the source disk,
+// so a resumed drain doesn't list them again anyway.
+const drainStateSaveInterval = 5 * time.Second
+
+// partFailure records the failed attempts at moving a part
+type partFailure struct {
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+}
+
+// drainStateFile is the drain state as written to disk
+type drainStateFile struct {
+	FromDisk string    `json:"from_disk"`
+	ToDisk   string    `json:"to_disk"`
+	Started  time.Time `json:"started"`
+	// CompletedTables had all their parts moved, a resumed run doesn't
+	// look at them again
+	CompletedTables []string `json:"completed_tables"`
+	// Moved lists the moved parts of the tables not completed yet
+	Moved    map[string][]string                `json:"moved"`
+	Failures map[string]map[string]*partFailure `json:"failures"`
+}
+
+// drainState is the progress of a drain-disk run, saved periodically so
+// that an interrupted run can be resumed. Parts are indexed by table and
+// part name.
+type drainState struct {
+	fromDisk  string
+	toDisk    string
+	started   time.Time
+	completed map[string]struct{}
+	moved     map[string]map[string]struct{}
+	failures  map[string]map[string]*partFailure
+
+	path  string
+	mu    sync.Mutex
+	saved time.Time
+}
+
+func newDrainState(path, fromDisk, toDisk string) *drainState {
+	return &drainState{
+		fromDisk:  fromDisk,
+		toDisk:    toDisk,
+		started:   time.Now(),
+		completed: make(map[string]struct{}),
+		moved:     make(map[string]map[string]struct{}),
+		failures:  make(map[string]map[string]*partFailure),
+		path:      path,
+		saved:     time.Now(),
+	}
+}
+
+// loadDrainState reads the state of the run being resumed, which must have
+// drained the same disks
+func loadDrainState(path, fromDisk, toDisk string) (*drainState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading drain state: %v", err)
+	}
+	var file drainStateFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing drain state %s: %v", path, err)
+	}
+	if file.FromDisk != fromDisk || file.ToDisk != toDisk {
+		return nil, fmt.Errorf("%s drained disk %s to %s, not %s to %s", path, file.FromDisk, file.ToDisk, fromDisk, toDisk)
+	}
+	s := newDrainState(path, fromDisk, toDisk)
+	s.started = file.Started
+	for _, table := range file.CompletedTables {
+		s.completed[table] = struct{}{}
+	}
+	for table, parts := range file.Moved {
+		s.moved[table] = make(map[string]struct{}, len(parts))
+		for _, part := range parts {
+			s.moved[table][part] = struct{}{}
+		}
+	}
+	for table, failures := range file.Failures {
+		s.failures[table] = failures
+	}
+	return s, nil
+}
+
+// checkNoDrainState refuses to start a new drain over the state of another
+// one, which would silently lose it
+func checkNoDrainState(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("drain state %s already exists, resume it with --resume or remove it to start over", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("checking drain state: %v", err)
+	}
+	return nil
+}
+
+func partTable(part diskPart) string {
+	return tableKey{part.database, part.table}.String()
+}
+
+func (s *drainState) tableCompleted(table string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.completed[table]
+	return ok
+}
+
+func (s *drainState) isMoved(part diskPart) bool {
+	_, ok := s.moved[partTable(part)][part.name]
+	return ok
+}
+
+// attempts is the number of times moving part failed so far
+func (s *drainState) attempts(part diskPart) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.failures[partTable(part)][part.name]; ok {
+		return f.Attempts
+	}
+	return 0
+}
+
+func (s *drainState) markMoved(part diskPart) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table := partTable(part)
+	if s.moved[table] == nil {
+		s.moved[table] = make(map[string]struct{})
+	}
+	s.moved[table][part.name] = struct{}{}
+	delete(s.failures[table], part.name)
+	if len(s.failures[table]) == 0 {
+		delete(s.failures, table)
+	}
+	return s.saveDue()
+}
+
+func (s *drainState) markFailed(part diskPart, err error) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	table := partTable(part)
+	if s.failures[table] == nil {
+		s.failures[table] = make(map[string]*partFailure)
+	}
+	f, ok := s.failures[table][part.name]
+	if !ok {
+		f = &partFailure{}
+		s.failures[table][part.name] = f
+	}
+	f.Attempts++
+	f.LastError = err.Error()
+	return s.saveDue()
+}
+
+// completeTables marks the tables whose parts were all moved or that had
+// nothing left to move, and saves the state
+func (s *drainState) completeTables(parts []diskPart, tables []tableKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make(map[string]bool)
+	for _, part := range parts {
+		if !s.isMoved(part) {
+			pending[partTable(part)] = true
+		}
+	}
+	for _, t := range tables {
+		table := t.String()
+		if pending[table] {
+			continue
+		}
+		s.completed[table] = struct{}{}
+		delete(s.moved, table)
+	}
+	return s.save()
+}
+
+// finished reports whether the drain is over: nothing is left on the
+// drained disk and no part failed to move
+func (s *drainState) finished(leftovers []leftoverTable) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(leftovers) == 0 && len(s.failures) == 0
+}
+
+// remove deletes the state file of a finished drain so that it doesn't
+// block the next one
+func (s *drainState) remove() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing drain state: %v", err)
+	}
+	return nil
+}
+
+// saveDue saves the state when the last save is older than
+// drainStateSaveInterval, the caller holds mu
+func (s *drainState) saveDue() error {
+	if time.Since(s.saved) < drainStateSaveInterval {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the state through a temporary file so a crash never leaves
+// it truncated, the caller holds mu
+func (s *drainState) save() error {
+	file := drainStateFile{
+		FromDisk:        s.fromDisk,
+		ToDisk:          s.toDisk,
+		Started:         s.started,
+		CompletedTables: make([]string, 0, len(s.completed)),
+		Moved:           make(map[string][]string, len(s.moved)),
+		Failures:        s.failures,
+	}
+	for table := range s.completed {
+		file.CompletedTables = append(file.CompletedTables, table)
+	}
+	sort.Strings(file.CompletedTables)
+	for table, parts := range s.moved {
+		names := make([]string, 0, len(parts))
+		for part := range parts {
+			names = append(names, part)
+		}
+		sort.Strings(names)
+		file.Moved[table] = names
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding drain state: %v", err)
+	}
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing drain state: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("writing drain state: %v", err)
+	}
+	s.saved = time.Now()
+	return nil
+}
+
+// pendingParts drops the parts a resumed run already moved and those that
+// failed maxAttempts times
+func (s *drainState) pendingParts(parts []diskPart, maxAttempts int) []diskPart {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []diskPart
+	for _, part := range parts {
+		if s.isMoved(part) {
+			continue
+		}
+		if f, ok := s.failures[partTable(part)][part.name]; ok && f.Attempts >= maxAttempts {
+			continue
+		}
+		pending = append(pending, part)
+	}
+	return pending
+}
+
+// leftoverTable is what remains of a table on the drained disk
+type leftoverTable struct {
+	table string
+	parts uint64
+	bytes uint64
+}
+
+func leftoverParts(ctx context.Context, conn driver.Conn, disk string) ([]leftoverTable, error) {
+	rows, err := conn.Query(ctx,
+		"select concat(database, '.', table), count(), sum(bytes_on_disk) from system.parts where active and disk_name = {disk:String} group by database, table order by database, table",
+		clickhouse.Named("disk", disk))
+	if err != nil {
+		return nil, fmt.Errorf("listing parts left on disk %s: %v", disk, err)
+	}
+	defer rows.Close()
+	var leftovers []leftoverTable
+	for rows.Next() {
+		var t leftoverTable
+		if err := rows.Scan(&t.table, &t.parts, &t.bytes); err != nil {
+			return nil, fmt.Errorf("listing parts left on disk %s: %v", disk, err)
+		}
+		leftovers = append(leftovers, t)
+	}
+	return leftovers, rows.Err()
+}
+
+// printDrainReport lists what is left on the drained disk and the parts
+// that failed to move
+func printDrainReport(w io.Writer, s *drainState, leftovers []leftoverTable, maxAttempts int) {
+	if len(leftovers) == 0 {
+		fmt.Fprintf(w, "\nDisk %s is drained, no active parts are left on it\n", s.fromDisk)
+	} else {
+		fmt.Fprintf(w, "\nLeft on disk %s:\n", s.fromDisk)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "table\tparts\tsize")
+		for _, t := range leftovers {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", t.table, t.parts, formatBytes(t.bytes))
+		}
+		tw.Flush()
+	}
+
+	if len(s.failures) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nParts that failed to move:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "table\tpart\tattempts\tgiven up\tlast error")
+	tables := make([]string, 0, len(s.failures))
+	for table := range s.failures {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		parts := make([]string, 0, len(s.failures[table]))
+		for part := range s.failures[table] {
+			parts = append(parts, part)
+		}
+		sort.Strings(parts)
+		for _, part := range parts {
+			f := s.failures[table][part]
+			givenUp := "no"
+			if f.Attempts >= maxAttempts {
+				givenUp = "yes"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", table, part, f.Attempts, givenUp, truncateQuery(f.LastError, 120))
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drain-state.json")
+	state := newDrainState(path, "hot", "cold")
+
+	moved := diskPart{database: "db", table: "events", name: "p1"}
+	failing := diskPart{database: "db", table: "events", name: "p2"}
+	givenUp := diskPart{database: "db", table: "persons", name: "p1"}
+	fresh := diskPart{database: "db", table: "persons", name: "p2"}
+
+	require.NoError(t, state.markMoved(moved))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, state.markFailed(givenUp, errors.New("no space")))
+	}
+	// saves are throttled, make the next one due
+	state.saved = time.Time{}
+	require.NoError(t, state.markFailed(failing, errors.New("timeout")))
+
+	_, err := loadDrainState(path, "hot", "warm")
+	assert.ErrorContains(t, err, "drained disk hot to cold, not hot to warm")
+
+	resumed, err := loadDrainState(path, "hot", "cold")
+	require.NoError(t, err)
+	assert.Equal(t, 1, resumed.attempts(failing))
+	assert.Equal(t, 3, resumed.attempts(givenUp))
+
+	parts := []diskPart{moved, failing, givenUp, fresh}
+	assert.Equal(t, []diskPart{failing, fresh}, resumed.pendingParts(parts, 3))
+	assert.Equal(t, []diskPart{failing, givenUp, fresh}, resumed.pendingParts(parts, 4))
+
+	// a retried part that moves is no longer a failure
+	require.NoError(t, resumed.markMoved(failing))
+	assert.Equal(t, 0, resumed.attempts(failing))
+
+	tables := []tableKey{{"db", "events"}, {"db", "persons"}, {"db", "empty"}}
+	require.NoError(t, resumed.completeTables(parts, tables))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var file drainStateFile
+	require.NoError(t, json.Unmarshal(data, &file))
+	assert.Equal(t, []string{"db.empty", "db.events"}, file.CompletedTables)
+	assert.Equal(t, map[string][]string{}, file.Moved)
+	assert.Equal(t, 3, file.Failures["db.persons"]["p1"].Attempts)
+
+	resumed, err = loadDrainState(path, "hot", "cold")
+	require.NoError(t, err)
+	assert.True(t, resumed.tableCompleted("db.events"))
+	assert.False(t, resumed.tableCompleted("db.persons"))
+}
+
+func TestDrainStateSaveInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drain-state.json")
+	state := newDrainState(path, "hot", "cold")
+	require.NoError(t, checkNoDrainState(path))
+
+	// moves are only saved once drainStateSaveInterval passed
+	require.NoError(t, state.markMoved(diskPart{database: "db", table: "events", name: "p1"}))
+	assert.NoFileExists(t, path)
+	state.saved = time.Now().Add(-drainStateSaveInterval)
+	require.NoError(t, state.markMoved(diskPart{database: "db", table: "events", name: "p2"}))
+	assert.FileExists(t, path)
+
+	assert.ErrorContains(t, checkNoDrainState(path), "resume it with --resume or remove it")
+}
+
+func TestDrainStateFinished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drain-state.json")
+	state := newDrainState(path, "hot", "cold")
+	require.NoError(t, state.completeTables(nil, []tableKey{{"db", "events"}}))
+
+	assert.False(t, state.finished([]leftoverTable{{table: "db.events", parts: 1}}))
+	require.NoError(t, state.markFailed(diskPart{database: "db", table: "events", name: "p1"}, errors.New("no space")))
+	assert.False(t, state.finished(nil))
+	require.NoError(t, state.markMoved(diskPart{database: "db", table: "events", name: "p1"}))
+	assert.True(t, state.finished(nil))
+
+	// a finished drain doesn't block the next one
+	require.NoError(t, state.remove())
+	assert.NoError(t, checkNoDrainState(path))
+	assert.NoError(t, state.remove())
+}
+
+// execConn is a connection whose Exec is stubbed, the rest of driver.Conn
+// isn't used by movePart
+type execConn struct {
+	driver.Conn
+	exec func(query string) error
+}
+
+func (c execConn) Exec(ctx context.Context, query string, args ...any) error {
+	return c.exec(query)
+}
+
+func TestMovePartStateSaveFailure(t *testing.T) {
+	// saving into a missing directory fails
+	state := newDrainState(filepath.Join(t.TempDir(), "missing", "drain-state.json"), "hot", "cold")
+	state.saved = time.Time{}
+	part := diskPart{database: "db", table: "events", name: "p1"}
+
+	conn := execConn{exec: func(string) error { return nil }}
+	require.NoError(t, movePart(context.Background(), conn, part, "cold", 3, state))
+	assert.True(t, state.isMoved(part))
+
+	// the final save still reports it
+	assert.ErrorContains(t, state.completeTables([]diskPart{part}, []tableKey{{"db", "events"}}), "writing drain state")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	assert.Equal(t, 5*time.Second, retryBackoff(1))
+	assert.Equal(t, 10*time.Second, retryBackoff(2))
+	assert.Equal(t, 40*time.Second, retryBackoff(4))
+	assert.Equal(t, time.Minute, retryBackoff(10))
+}
+
+func TestPrintDrainReport(t *testing.T) {
+	state := newDrainState(filepath.Join(t.TempDir(), "drain-state.json"), "hot", "cold")
+	require.NoError(t, state.markFailed(diskPart{database: "db", table: "events", name: "p1"}, errors.New("no space")))
+
+	var buf bytes.Buffer
+	printDrainReport(&buf, state, []leftoverTable{{table: "db.events", parts: 1, bytes: 2048}}, 3)
+	out := buf.String()
+	assert.Contains(t, out, "Left on disk hot:")
+	assert.Contains(t, out, "db.events  1      2.00 KiB")
+	assert.Contains(t, out, "db.events  p1    1         no        no space")
+
+	buf.Reset()
+	printDrainReport(&buf, newDrainState("", "hot", "cold"), nil, 3)
+	assert.Equal(t, "\nDisk hot is drained, no active parts are left on it\n", buf.String())
+}
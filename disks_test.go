@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMovePartQuery(t *testing.T) {
+	part := diskPart{database: "posthog", table: "events", name: "202401_1_10_2"}
+	assert.Equal(t, "ALTER TABLE `posthog`.`events` MOVE PART '202401_1_10_2' TO DISK 'cold'", movePartQuery(part, "cold"))
+
+	part = diskPart{database: "my db", table: "a`b", name: "all_1_1_0"}
+	assert.Equal(t, "ALTER TABLE `my db`.`a\\`b` MOVE PART 'all_1_1_0' TO DISK 'it\\'s'", movePartQuery(part, "it's"))
+}
+
+func TestEffectiveParallel(t *testing.T) {
+	tests := []struct {
+		requested int
+		poolSize  int
+		want      int
+	}{
+		{requested: 0, poolSize: 8, want: 8},
+		{requested: 4, poolSize: 8, want: 4},
+		{requested: 16, poolSize: 8, want: 8},
+		{requested: 4, poolSize: 0, want: 4},
+		{requested: 0, poolSize: 0, want: 1},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, effectiveParallel(tt.requested, tt.poolSize), "requested %d, pool size %d", tt.requested, tt.poolSize)
+	}
+}
+
+func TestMoveConnections(t *testing.T) {
+	assert.Equal(t, 6, moveConnections(4))
+	assert.Equal(t, maxDefaultMovers+reservedMoveConns, moveConnections(0))
+	assert.Equal(t, maxDefaultMovers+reservedMoveConns, moveConnections(100))
+}
+
+func TestInterleaveTables(t *testing.T) {
+	parts := []diskPart{
+		{database: "db", table: "a", name: "a1"},
+		{database: "db", table: "a", name: "a2"},
+		{database: "db", table: "a", name: "a3"},
+		{database: "db", table: "b", name: "b1"},
+		{database: "other", table: "a", name: "oa1"},
+	}
+	var names []string
+	for _, part := range interleaveTables(parts) {
+		names = append(names, part.name)
+	}
+	assert.Equal(t, []string{"a1", "b1", "oa1", "a2", "a3"}, names)
+	assert.Empty(t, interleaveTables(nil))
+}
+
+func TestBuildPlan(t *testing.T) {
+	parts := []diskPart{
+		{database: "db", table: "events", name: "p1", bytes: 100},
+		{database: "db", table: "persons", name: "p1", bytes: 10},
+		{database: "db", table: "events", name: "p2", bytes: 200},
+	}
+	policies := map[tableKey]string{
+		{"db", "events"}:  "tiered",
+		{"db", "persons"}: "default",
+	}
+	policyDisks := map[string][]string{
+		"tiered":  {"default", "cold"},
+		"default": {"default"},
+	}
+	plan := buildPlan(parts, "cold", policies, policyDisks)
+	assert.Equal(t, uint64(310), plan.bytes)
+	assert.Equal(t, []tablePlan{
+		{tableKey: tableKey{"db", "events"}, storagePolicy: "tiered", parts: 2, bytes: 300, policyHasDisk: true},
+		{tableKey: tableKey{"db", "persons"}, storagePolicy: "default", parts: 1, bytes: 10, policyHasDisk: false},
+	}, plan.tables)
+	assert.Equal(t, []tablePlan{plan.tables[1]}, plan.unmovableTables())
+
+	var buf bytes.Buffer
+	printPlan(&buf, plan)
+	out := buf.String()
+	assert.Contains(t, out, "Plan: move 3 parts (310.00 B) of 2 tables to disk cold")
+	assert.Contains(t, out, "db.persons  1      10.00 B   default         NO")
+	assert.Contains(t, out, "1 tables can't be moved, disk cold isn't in their storage policy:\n  db.persons (policy default)\n")
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0.00 B", formatBytes(0))
+	assert.Equal(t, "1.50 KiB", formatBytes(1536))
+	assert.Equal(t, "2.00 TiB", formatBytes(2<<40))
+}
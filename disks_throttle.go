@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// pauseWindow is a time of day range, in the local time zone, during which
+// no part moves start. A window ending before it starts spans midnight.
+type pauseWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+func (w pauseWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	return clock(w.start) + "-" + clock(w.end)
+}
+
+// sinceMidnight is the time of day of t
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+// resumeAt is when the window containing t ends, ok is false when t isn't
+// in the window
+func (w pauseWindow) resumeAt(t time.Time) (time.Time, bool) {
+	now := sinceMidnight(t)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch {
+	case w.start <= w.end && now >= w.start && now < w.end:
+		return midnight.Add(w.end), true
+	case w.start > w.end && now >= w.start:
+		return midnight.AddDate(0, 0, 1).Add(w.end), true
+	case w.start > w.end && now < w.end:
+		return midnight.Add(w.end), true
+	}
+	return time.Time{}, false
+}
+
+// parsePauseWindows parses windows given as HH:MM-HH:MM, e.g. 09:00-18:00
+func parsePauseWindows(specs []string) ([]pauseWindow, error) {
+	windows := make([]pauseWindow, 0, len(specs))
+	for _, spec := range specs {
+		start, end, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid pause window '%s', expected HH:MM-HH:MM", spec)
+		}
+		var (
+			window pauseWindow
+			err    error
+		)
+		if window.start, err = parseClock(start); err != nil {
+			return nil, fmt.Errorf("invalid pause window '%s': %v", spec, err)
+		}
+		if window.end, err = parseClock(end); err != nil {
+			return nil, fmt.Errorf("invalid pause window '%s': %v", spec, err)
+		}
+		if window.start == window.end {
+			return nil, fmt.Errorf("invalid pause window '%s', it starts and ends at the same time", spec)
+		}
+		windows = append(windows, window)
+	}
+	if coverWholeDay(windows) {
+		return nil, fmt.Errorf("the pause windows %v cover the whole day, no part would ever move", specs)
+	}
+	return windows, nil
+}
+
+// coverWholeDay reports whether the windows leave no time of day to move
+// parts in. A gap between windows starts where a window ends, so the day is
+// covered when every window ends inside another one.
+func coverWholeDay(windows []pauseWindow) bool {
+	if len(windows) == 0 {
+		return false
+	}
+	day := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, w := range windows {
+		covered := false
+		for _, other := range windows {
+			if _, ok := other.resumeAt(day.Add(w.end)); ok {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("'%s' isn't a time of day like 09:30", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// moveThrottle paces the start of part moves so that on average no more
+// than maxBytesPerSec of bytes_on_disk are moved, and holds them back during
+// the pause windows. Moves already running when a window opens finish, the
+// server can't pause an ALTER TABLE ... MOVE PART.
+type moveThrottle struct {
+	maxBytesPerSec uint64
+	windows        []pauseWindow
+
+	// next is when the byte budget allows the next move to start
+	next  time.Time
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newMoveThrottle(maxBytesPerSec uint64, windows []pauseWindow) *moveThrottle {
+	return &moveThrottle{
+		maxBytesPerSec: maxBytesPerSec,
+		windows:        windows,
+		now:            time.Now,
+		sleep:          sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// transferTime is how long moving bytes takes at the byte budget
+func (t *moveThrottle) transferTime(bytes uint64) time.Duration {
+	if t.maxBytesPerSec == 0 {
+		return 0
+	}
+	return time.Duration(float64(bytes) / float64(t.maxBytesPerSec) * float64(time.Second))
+}
+
+// pausedUntil is when the pause windows containing now end, windows
+// following each other are waited out together
+func (t *moveThrottle) pausedUntil(now time.Time) (time.Time, bool) {
+	until, paused := now, false
+	for found := true; found; {
+		found = false
+		for _, w := range t.windows {
+			if end, ok := w.resumeAt(until); ok {
+				until, paused, found = end, true, true
+			}
+		}
+	}
+	return until, paused
+}
+
+// wait blocks until a part of the given size may start moving. It is called
+// by the single dispatcher of moveParts and isn't safe for concurrent use.
+func (t *moveThrottle) wait(ctx context.Context, bytes uint64) error {
+	if t == nil {
+		return nil
+	}
+	if delay := t.next.Sub(t.now()); delay > 0 {
+		if err := t.sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+	if until, paused := t.pausedUntil(t.now()); paused {
+		fmt.Printf("Pausing moves until %s, inside a pause window\n", until.Format("2006-01-02 15:04"))
+		if err := t.sleep(ctx, until.Sub(t.now())); err != nil {
+			return err
+		}
+		fmt.Println("Resuming moves")
+	}
+	// a pause or a slow dispatch doesn't bank budget for a burst
+	t.next = t.now().Add(t.transferTime(bytes))
+	return nil
+}
+
+// printThrottle describes how the moves are paced, if they are
+func printThrottle(w io.Writer, t *moveThrottle, bytes uint64) {
+	if t.maxBytesPerSec > 0 {
+		fmt.Fprintf(w, "Moving at most %s/s, %s takes at least %s\n",
+			formatBytes(t.maxBytesPerSec), formatBytes(bytes), t.transferTime(bytes).Round(time.Second))
+	}
+	if len(t.windows) > 0 {
+		windows := make([]string, 0, len(t.windows))
+		for _, window := range t.windows {
+			windows = append(windows, window.String())
+		}
+		fmt.Fprintf(w, "No moves start during %s (local time)\n", strings.Join(windows, ", "))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePauseWindows(t *testing.T) {
+	windows, err := parsePauseWindows([]string{"09:00-18:00", " 22:30 - 06:15 "})
+	require.NoError(t, err)
+	assert.Equal(t, []pauseWindow{
+		{start: 9 * time.Hour, end: 18 * time.Hour},
+		{start: 22*time.Hour + 30*time.Minute, end: 6*time.Hour + 15*time.Minute},
+	}, windows)
+	assert.Equal(t, "22:30-06:15", windows[1].String())
+
+	_, err = parsePauseWindows([]string{"09:00"})
+	assert.ErrorContains(t, err, "expected HH:MM-HH:MM")
+	_, err = parsePauseWindows([]string{"09:00-25:00"})
+	assert.ErrorContains(t, err, "'25:00' isn't a time of day")
+	_, err = parsePauseWindows([]string{"09:00-09:00"})
+	assert.ErrorContains(t, err, "starts and ends at the same time")
+	_, err = parsePauseWindows([]string{"00:00-12:00", "12:00-00:00"})
+	assert.ErrorContains(t, err, "cover the whole day")
+	_, err = parsePauseWindows([]string{"00:00-12:00", "12:01-00:00"})
+	assert.NoError(t, err)
+}
+
+func TestPauseWindowResumeAt(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 10, hour, minute, 0, 0, time.UTC)
+	}
+	day := pauseWindow{start: 9 * time.Hour, end: 18 * time.Hour}
+	night := pauseWindow{start: 22 * time.Hour, end: 6 * time.Hour}
+
+	resume, ok := day.resumeAt(at(12, 0))
+	assert.True(t, ok)
+	assert.Equal(t, at(18, 0), resume)
+	_, ok = day.resumeAt(at(18, 0))
+	assert.False(t, ok)
+
+	resume, ok = night.resumeAt(at(23, 0))
+	assert.True(t, ok)
+	assert.Equal(t, at(6, 0).AddDate(0, 0, 1), resume)
+	resume, ok = night.resumeAt(at(1, 0))
+	assert.True(t, ok)
+	assert.Equal(t, at(6, 0), resume)
+	_, ok = night.resumeAt(at(12, 0))
+	assert.False(t, ok)
+
+	// back to back windows are waited out together
+	throttle := newMoveThrottle(0, []pauseWindow{night, {start: 6 * time.Hour, end: 7 * time.Hour}})
+	until, paused := throttle.pausedUntil(at(23, 0))
+	assert.True(t, paused)
+	assert.Equal(t, at(7, 0).AddDate(0, 0, 1), until)
+}
+
+func TestMoveThrottleWait(t *testing.T) {
+	now := time.Date(2024, 3, 10, 8, 59, 0, 0, time.UTC)
+	var slept []time.Duration
+	throttle := newMoveThrottle(100, []pauseWindow{{start: 9 * time.Hour, end: 18 * time.Hour}})
+	throttle.now = func() time.Time { return now }
+	throttle.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		now = now.Add(d)
+		return nil
+	}
+
+	ctx := context.Background()
+	// the first part starts right away and 1000 bytes take 10s of budget
+	require.NoError(t, throttle.wait(ctx, 1000))
+	assert.Empty(t, slept)
+	require.NoError(t, throttle.wait(ctx, 50))
+	assert.Equal(t, []time.Duration{10 * time.Second}, slept)
+
+	// a part due inside the pause window waits for its end
+	now = now.Add(time.Minute)
+	slept = nil
+	require.NoError(t, throttle.wait(ctx, 50))
+	assert.Equal(t, []time.Duration{9*time.Hour - 10*time.Second}, slept)
+	assert.Equal(t, time.Date(2024, 3, 10, 18, 0, 0, 0, time.UTC), now)
+
+	unlimited := newMoveThrottle(0, nil)
+	unlimited.sleep = throttle.sleep
+	slept = nil
+	require.NoError(t, unlimited.wait(ctx, 1<<40))
+	require.NoError(t, unlimited.wait(ctx, 1<<40))
+	assert.Empty(t, slept)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	throttle.sleep = sleepContext
+	throttle.next = time.Now().Add(time.Hour)
+	throttle.now = time.Now
+	throttle.windows = nil
+	assert.ErrorIs(t, throttle.wait(cancelled, 1), context.Canceled)
+}
+
+func TestPrintThrottle(t *testing.T) {
+	var buf bytes.Buffer
+	printThrottle(&buf, newMoveThrottle(0, nil), 1<<30)
+	assert.Empty(t, buf.String())
+
+	printThrottle(&buf, newMoveThrottle(1<<20, []pauseWindow{{start: 9 * time.Hour, end: 18 * time.Hour}}), 1<<30)
+	assert.Equal(t, "Moving at most 1.00 MiB/s, 1.00 GiB takes at least 17m4s\nNo moves start during 09:00-18:00 (local time)\n", buf.String())
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -35,10 +38,12 @@ func main() {
 		},
 	}
 
-	cmd.AddCommand(&cobra.Command{
+	var moveOpts MoveOptions
+
+	moveToCmd := &cobra.Command{
 		Use:   "moveto",
 		Short: "subcommand to move all parts of a table from a disk to another disk <from_disk> <to_disk> <database> <table> as arguments",
-		Args:  cobra.MinimumNArgs(3),
+		Args:  cobra.MinimumNArgs(4),
 		Run: func(cmd *cobra.Command, args []string) {
 			var (
 				fromDisk = args[0]
@@ -47,17 +52,28 @@ func main() {
 				table    = args[3]
 			)
 			fmt.Printf("Moving parts to from disk %s to disk %s for table: %s.%s\n", fromDisk, toDisk, database, table)
-			connUS, err := connectUS()
+			moveOpts.MaxOpenConns = moveConnections(moveOpts.Parallel)
+			connUS, err := connectUS(moveOpts.MaxOpenConns)
 			if err != nil {
 				panic(err)
 			}
-			ctx := context.Background()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 			testConection(ctx, connUS)
-			moveTo(ctx, connUS, database, table, fromDisk, toDisk)
+			if err := moveTo(ctx, connUS, database, table, fromDisk, toDisk, moveOpts); err != nil {
+				log.Errorln(err)
+				panic(err)
+			}
 		},
-	})
-
-	cmd.AddCommand(&cobra.Command{
+	}
+	moveToCmd.Flags().IntVar(&moveOpts.Parallel, "parallel", 0, "Number of parts moved at once, capped by the server's background_move_pool_size (0 uses it)")
+	moveToCmd.Flags().BoolVar(&moveOpts.DryRun, "dry-run", false, "Print every part that would be moved, the totals and whether the table's storage policy contains the target disk, without moving anything")
+	moveToCmd.Flags().Float64Var(&moveOpts.Headroom, "headroom", 0.1, "Fraction of the target disk that must stay free besides its keep_free_space, moves that don't fit are refused")
+	moveToCmd.Flags().Uint64Var(&moveOpts.MaxBytesPerSec, "max-bytes-per-sec", 0, "Pace the moves so that on average no more bytes_on_disk than this are moved per second (0 doesn't limit them)")
+	moveToCmd.Flags().StringArrayVar(&moveOpts.PauseWindows, "pause-window", []string{}, "Time of day range as HH:MM-HH:MM, local time, during which no moves start (repeatable)")
+	cmd.AddCommand(moveToCmd)
+
+	drainDiskCmd := &cobra.Command{
 		Use:   "drain-disk",
 		Short: "subcommand to move all parts of all tables from a disk to another disk <from_disk> <to_disk> as arguments",
 		Args:  cobra.MinimumNArgs(2),
@@ -67,15 +83,29 @@ func main() {
 				toDisk   = args[1]
 			)
 			fmt.Printf("Moving parts to from disk %s to disk %s\n", fromDisk, toDisk)
-			connUS, err := connectUS()
+			moveOpts.MaxOpenConns = moveConnections(moveOpts.Parallel)
+			connUS, err := connectUS(moveOpts.MaxOpenConns)
 			if err != nil {
 				panic(err)
 			}
-			ctx := context.Background()
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 			testConection(ctx, connUS)
-			drainDisk(ctx, connUS, fromDisk, toDisk)
+			if err := drainDisk(ctx, connUS, fromDisk, toDisk, moveOpts); err != nil {
+				log.Errorln(err)
+				panic(err)
+			}
 		},
-	})
+	}
+	drainDiskCmd.Flags().IntVar(&moveOpts.Parallel, "parallel", 0, "Number of parts moved at once across all tables, capped by the server's background_move_pool_size (0 uses it)")
+	drainDiskCmd.Flags().BoolVar(&moveOpts.DryRun, "dry-run", false, "Print every part that would be moved, the totals per table and whether each table's storage policy contains the target disk, without moving anything")
+	drainDiskCmd.Flags().Float64Var(&moveOpts.Headroom, "headroom", 0.1, "Fraction of the target disk that must stay free besides its keep_free_space, moves that don't fit are refused")
+	drainDiskCmd.Flags().Uint64Var(&moveOpts.MaxBytesPerSec, "max-bytes-per-sec", 0, "Pace the moves so that on average no more bytes_on_disk than this are moved per second (0 doesn't limit them)")
+	drainDiskCmd.Flags().StringArrayVar(&moveOpts.PauseWindows, "pause-window", []string{}, "Time of day range as HH:MM-HH:MM, local time, during which no moves start (repeatable)")
+	drainDiskCmd.Flags().StringVar(&moveOpts.StateFile, "state-file", "drain-state.json", "File recording the moved and failed parts of the drain")
+	drainDiskCmd.Flags().BoolVar(&moveOpts.Resume, "resume", false, "Resume the drain recorded in --state-file, skipping the tables and parts already moved")
+	drainDiskCmd.Flags().IntVar(&moveOpts.MaxAttempts, "max-attempts", 3, "Number of times a failing part is moved, over all the runs of the drain, before giving up on it")
+	cmd.AddCommand(drainDiskCmd)
 
 	var (
 		noKafkas      = false
@@ -217,44 +247,252 @@ func main() {
 		},
 	})
 
-	cmd.AddCommand(&cobra.Command{
+	var (
+		replayWorkers        = 1000
+		replayMaxInFlight    = 0
+		replayMaxOpenConns   = 0
+		replayMaxIdleConns   = 2
+		replaySpeed          = 1.0
+		replayAsFast         = false
+		replayFromFile       = ""
+		replayVerify         = false
+		replayVerifySource   = ""
+		replayGate           = GateThresholds{}
+		replayVerdictFile    = "verdict.json"
+		replayKinds          = []string{"Select"}
+		replayShadowDB       = ""
+		replayRewriteRules   = ""
+		replayNoDefaultRules = false
+		replaySettings       = []string{}
+		replayMatrixFile     = ""
+		replaySampling       = WorkloadSampling{}
+		replayRunDir         = "."
+		replayResume         = ""
+		replayRunID          = ""
+		replayTargetCluster  = ""
+		replayCompareTargets = []string{}
+		replayStages         = []string{}
+		replaySinks          = []string{}
+		replayResultsURL     = ""
+		replayResultsTable   = "replay_results"
+		replayAllowFile      = ""
+		replayProgressEvery  = 10 * time.Second
+		replayMetricsAddr    = ""
+		replayReadOnly       = false
+	)
+
+	replayCmd := &cobra.Command{
 		Use:   "replay",
 		Short: "Replay a portion of query history from one cluster onto another, for benchmarking. Arguments are cluster, start and stop dates.",
-		Args:  cobra.MinimumNArgs(5),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if replayFromFile != "" || replayResume != "" {
+				return cobra.ExactArgs(1)(cmd, args)
+			}
+			return cobra.MinimumNArgs(5)(cmd, args)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
+			opts := ReplayOptions{
+				FromFile:     replayFromFile,
+				Kinds:        replayKinds,
+				Sampling:     replaySampling,
+				Workers:      replayWorkers,
+				MaxInFlight:  replayMaxInFlight,
+				MaxOpenConns: replayMaxOpenConns,
+				MaxIdleConns: replayMaxIdleConns,
 
-			var (
-				cluster                  = args[0]
-				clusterAConnectionString = &args[1]
-				clusterBConnectionString = &args[2]
-				startStr                 = args[3]
-				stopStr                  = args[4]
-				skipFile                 string
-			)
+				Speed:            replaySpeed,
+				AsFastAsPossible: replayAsFast,
+
+				ShadowDatabase: replayShadowDB,
+
+				RewriteRulesFile:  replayRewriteRules,
+				NoDefaultRewrites: replayNoDefaultRules,
+
+				Verify:   replayVerify,
+				ReadOnly: replayReadOnly,
+
+				Gate:        replayGate,
+				VerdictFile: replayVerdictFile,
+
+				RunDir:        replayRunDir,
+				RunID:         replayRunID,
+				TargetCluster: replayTargetCluster,
 
-			if len(args) > 5 {
-				skipFile = args[5]
+				Sinks:        replaySinks,
+				ResultsTable: replayResultsTable,
 			}
 
-			start, err := time.Parse("2006-01-02 15:04:05", startStr)
+			settings, err := parseSettingFlags(replaySettings)
 			if err != nil {
 				log.Errorln(err)
 				panic(err)
 			}
+			var matrix []SettingsSet
+			if replayMatrixFile != "" {
+				matrix, err = loadSettingsMatrix(replayMatrixFile)
+				if err != nil {
+					log.Errorln(err)
+					panic(err)
+				}
+			}
+			opts.SettingsSets = buildSettingsSets(settings, matrix)
+			opts.LoadStages, err = parseLoadStages(replayStages)
+			if err != nil {
+				log.Errorln(err)
+				panic(err)
+			}
+			if err := validateSinks(opts.Sinks); err != nil {
+				log.Errorln(err)
+				panic(err)
+			}
 
-			stop, err := time.Parse("2006-01-02 15:04:05", stopStr)
+			// A resumed replay continues with the options it was started with
+			if replayResume != "" {
+				resumed, err := loadRunConfig(replayResume)
+				if err != nil {
+					log.Errorln(err)
+					panic(err)
+				}
+				opts = *resumed
+				replayVerify = opts.Verify
+				if replayVerify && replayVerifySource == "" {
+					err := fmt.Errorf("the replay being resumed verifies results, --verify-source is required")
+					log.Errorln(err)
+					panic(err)
+				}
+			}
+			opts.ProgressInterval = replayProgressEvery
+			opts.MetricsAddr = replayMetricsAddr
+			if includes(opts.Sinks, "clickhouse") && replayResultsURL == "" {
+				err := fmt.Errorf("the clickhouse sink needs --results-url")
+				log.Errorln(err)
+				panic(err)
+			}
+
+			// When replaying from a workload file or resuming the only argument is the target
+			targetConnectionString := &args[0]
+			if replayFromFile == "" && replayResume == "" {
+				targetConnectionString = &args[2]
+				sourceArgs := append([]string{args[0], args[1]}, args[3:]...)
+				if err := parseCaptureArgs(sourceArgs, &opts); err != nil {
+					log.Errorln(err)
+					panic(err)
+				}
+				opts.AllowFile = replayAllowFile
+			}
+
+			connTarget, err := NewCHConn(targetConnectionString)
 			if err != nil {
 				log.Errorln(err)
 				panic(err)
 			}
+			opts.ToConn = connTarget
+			for _, compareTarget := range replayCompareTargets {
+				compareTarget := compareTarget
+				conn, err := NewCHConn(&compareTarget)
+				if err != nil {
+					log.Errorln(err)
+					panic(err)
+				}
+				opts.CompareConns = append(opts.CompareConns, conn)
+			}
+
+			if replayResultsURL != "" {
+				opts.ResultsConn, err = NewCHConn(&replayResultsURL)
+				if err != nil {
+					log.Errorln(err)
+					panic(err)
+				}
+			}
+
+			if replayVerify {
+				opts.VerifyConn = opts.FromConn
+				if replayVerifySource != "" {
+					opts.VerifyConn, err = NewCHConn(&replayVerifySource)
+					if err != nil {
+						log.Errorln(err)
+						panic(err)
+					}
+				}
+			}
 
-			connClusterA, err := NewCHConn(clusterAConnectionString)
+			// the first Ctrl-C drains the replay, a second one exits immediately
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				stop()
+			}()
+
+			err = replayQueryHistory(ctx, &opts)
+			if errors.Is(err, errReplayGateFailed) {
+				log.Errorf("%v, see %s", err, replayVerdictFile)
+				os.Exit(2)
+			}
+			if errors.Is(err, context.Canceled) {
+				log.Errorln(err)
+				os.Exit(130)
+			}
 			if err != nil {
 				log.Errorln(err)
 				panic(err)
 			}
+		},
+	}
+
+	replayCmd.Flags().IntVar(&replayWorkers, "workers", 1000, "Number of worker goroutines replaying queries")
+	replayCmd.Flags().IntVar(&replayMaxInFlight, "max-in-flight", 0, "Maximum number of queries running on the target at once (0 means one per worker)")
+	replayCmd.Flags().IntVar(&replayMaxOpenConns, "max-open-conns", 0, "Maximum number of open connections to the target (0 means unlimited)")
+	replayCmd.Flags().IntVar(&replayMaxIdleConns, "max-idle-conns", 2, "Maximum number of idle connections kept to the target")
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1.0, "Replay speed multiplier relative to the original timeline (e.g. 10 or 0.5)")
+	replayCmd.Flags().BoolVar(&replayAsFast, "as-fast-as-possible", false, "Ignore original timestamps and dispatch queries as fast as workers allow")
+	replayCmd.Flags().StringVar(&replayFromFile, "from-file", "", "Replay a workload file produced by capture instead of querying the source cluster; the only argument is then <to_clickhouse_url>")
+	replayCmd.Flags().BoolVar(&replayVerify, "verify", false, "Run each query on the source as well and compare row counts and result hashes")
+	replayCmd.Flags().StringVar(&replayVerifySource, "verify-source", "", "ClickHouse url to verify results against (defaults to the source cluster, required with --from-file)")
+	replayCmd.Flags().Float64Var(&replayGate.MaxP95Slowdown, "max-p95-slowdown", -1, "Fail with exit code 2 if any query shape's p95 duration got slower by more than this fraction, e.g. 0.2 (negative disables)")
+	replayCmd.Flags().Float64Var(&replayGate.MaxErrorRate, "max-error-rate", -1, "Fail with exit code 2 if the overall or any query shape's error rate exceeds this fraction, e.g. 0.01 (negative disables)")
+	replayCmd.Flags().IntVar(&replayGate.MinCount, "gate-min-count", 10, "Minimum executions of a query shape before it is evaluated against the thresholds")
+	replayCmd.Flags().StringVar(&replayVerdictFile, "verdict-file", "verdict.json", "Path of the machine-readable verdict written when thresholds are set")
+	replayCmd.Flags().StringSliceVar(&replayKinds, "kinds", []string{"Select"}, "Query kinds to replay, Select and/or Insert (only INSERT ... SELECT is replayed)")
+	replayCmd.Flags().StringVar(&replayShadowDB, "shadow-database", "", "Redirect replayed inserts into tables of this database on the target")
+	replayCmd.Flags().StringVar(&replayRewriteRules, "rewrite-rules", "", "JSON file of rewrite rules applied to every query before it is replayed")
+	replayCmd.Flags().BoolVar(&replayNoDefaultRules, "no-default-rewrites", false, "Don't remove the allow_experimental_object_type setting from replayed queries, which is done by default")
+	replayCmd.Flags().StringArrayVar(&replaySettings, "setting", []string{}, "ClickHouse setting key=value applied to every replayed query (repeatable)")
+	replayCmd.Flags().StringVar(&replayMatrixFile, "settings-matrix", "", "JSON file of named settings sets, the workload is replayed once per set")
+	replayCmd.Flags().StringVar(&replayRunDir, "run-dir", ".", "Directory for run.json, output.csv, summary.json, checkpoint.json and the captured workload")
+	replayCmd.Flags().StringVar(&replayResume, "resume", "", "Resume the interrupted replay in this run directory using its run.json; the only argument is then <to_clickhouse_url>")
+	replayCmd.Flags().StringVar(&replayRunID, "run-id", "", "Id of the run, sent as log_comment and used to build the query_id of every replayed query (defaults to one based on the start time)")
+	replayCmd.Flags().StringVar(&replayTargetCluster, "target-cluster", "", "Cluster name of the target, server-side metrics are then harvested from all of its replicas")
+	replayCmd.Flags().StringArrayVar(&replayCompareTargets, "compare-target", []string{}, "Additional ClickHouse url every query is replayed on at the same time as the target, for A/B comparisons (repeatable)")
+	replayCmd.Flags().StringSliceVar(&replayStages, "closed-loop-stages", []string{}, "Replay in closed-loop mode through these duration:users stages, e.g. 1m:10,2m:50,2m:100; virtual users issue random workload queries back to back")
+	replayCmd.Flags().StringVar(&replayAllowFile, "allow-file", "", "Only capture query shapes matched by an entry of this file, in the same format as the skip file")
+	replayCmd.Flags().StringSliceVar(&replaySinks, "sink", []string{}, "Additional result sinks, jsonl writes output.jsonl to the run directory and clickhouse inserts into --results-table; output.csv is always written")
+	replayCmd.Flags().StringVar(&replayResultsURL, "results-url", "", "ClickHouse url the clickhouse sink writes results to, required again when resuming")
+	replayCmd.Flags().StringVar(&replayResultsTable, "results-table", "replay_results", "Table the clickhouse sink inserts results into, created if missing along with <table>_runs")
+	replayCmd.Flags().BoolVar(&replayReadOnly, "read-only", false, "Never modify the targets: reject every statement but SELECT, reporting the rejected queries, and replay with readonly=2")
+	replayCmd.Flags().DurationVar(&replayProgressEvery, "progress-interval", 10*time.Second, "How often to log the replay's progress: dispatched, completed and in-flight queries, virtual-time lag, rolling p95 and error rate (0 disables)")
+	replayCmd.Flags().StringVar(&replayMetricsAddr, "metrics-addr", "", "Serve the replay's progress as Prometheus metrics at /metrics on this address, e.g. localhost:9091")
+	addSamplingFlags(replayCmd, &replaySampling)
+	cmd.AddCommand(replayCmd)
+
+	var (
+		captureOutput    = "queries.csv"
+		captureKinds     = []string{"Select"}
+		captureSampling  = WorkloadSampling{}
+		captureAllowFile = ""
+	)
 
-			connClusterB, err := NewCHConn(clusterBConnectionString)
+	captureCmd := &cobra.Command{
+		Use:   "capture",
+		Short: "Capture a portion of query history into a workload file for replay. Arguments are cluster, clickhouse url, start and stop dates.",
+		Args:  cobra.MinimumNArgs(4),
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := ReplayOptions{
+				Kinds:     captureKinds,
+				Sampling:  captureSampling,
+				AllowFile: captureAllowFile,
+			}
+			err := parseCaptureArgs(args, &opts)
 			if err != nil {
 				log.Errorln(err)
 				panic(err)
@@ -262,14 +500,95 @@ func main() {
 
 			ctx := context.Background()
 
-			err = replayQueryHistory(ctx, connClusterA, connClusterB, cluster, start, stop, skipFile)
+			err = captureQueryHistory(ctx, &opts, captureOutput)
 			if err != nil {
 				log.Errorln(err)
 				panic(err)
 			}
 		},
-	})
+	}
+
+	captureCmd.Flags().StringVar(&captureOutput, "output", "queries.csv", "Path of the workload file to write")
+	captureCmd.Flags().StringSliceVar(&captureKinds, "kinds", []string{"Select"}, "Query kinds to capture, Select and/or Insert (only INSERT ... SELECT is captured)")
+	captureCmd.Flags().StringVar(&captureAllowFile, "allow-file", "", "Only capture query shapes matched by an entry of this file, in the same format as the skip file")
+	addSamplingFlags(captureCmd, &captureSampling)
+	cmd.AddCommand(captureCmd)
+
+	var (
+		diffOutput = "diff.json"
+		diffLimit  = 20
+	)
+
+	replayDiffCmd := &cobra.Command{
+		Use:   "replay-diff",
+		Short: "Compare two replay runs. Arguments are the run directories (or output.csv files) of run A and run B.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			diff, err := diffRuns(args[0], args[1])
+			if err != nil {
+				log.Errorln(err)
+				panic(err)
+			}
+			printDiff(os.Stdout, diff, diffLimit)
+			if err := writeDiff(diffOutput, diff); err != nil {
+				log.Errorln(err)
+				panic(err)
+			}
+		},
+	}
+
+	replayDiffCmd.Flags().StringVar(&diffOutput, "output", "diff.json", "Path of the JSON diff to write")
+	replayDiffCmd.Flags().IntVar(&diffLimit, "limit", 20, "Number of query shapes and errors to print (0 prints all)")
+	cmd.AddCommand(replayDiffCmd)
 
 	// LETS GOOOOO
 	cmd.Execute()
 }
+
+func addSamplingFlags(cmd *cobra.Command, sampling *WorkloadSampling) {
+	cmd.Flags().Float64Var(&sampling.SamplePercent, "sample-percent", 0, "Keep roughly this percentage of query executions (0 keeps all)")
+	cmd.Flags().IntVar(&sampling.TopShapes, "top-shapes", 0, "Keep only the N query shapes with the highest total duration (0 keeps all)")
+	cmd.Flags().IntVar(&sampling.MaxPerShape, "max-per-shape", 0, "Keep at most N executions per normalized query hash (0 keeps all)")
+	cmd.Flags().StringSliceVar(&sampling.Users, "user", nil, "Only keep queries run by these users")
+	cmd.Flags().StringSliceVar(&sampling.InitialUsers, "initial-user", nil, "Only keep queries initiated by these users")
+	cmd.Flags().StringSliceVar(&sampling.Databases, "database", nil, "Only keep queries run with these current databases")
+	cmd.Flags().Uint64Var(&sampling.Seed, "seed", 0, "Seed for sampling, the same seed always selects the same queries")
+}
+
+// parseCaptureArgs fills in the source side of opts from the positional
+// arguments <cluster> <from_clickhouse_url> <start_date> <end_date> [skip_file]
+func parseCaptureArgs(args []string, opts *ReplayOptions) error {
+	var (
+		cluster                  = args[0]
+		clusterAConnectionString = &args[1]
+		startStr                 = args[2]
+		stopStr                  = args[3]
+		skipFile                 string
+	)
+
+	if len(args) > 4 {
+		skipFile = args[4]
+	}
+
+	start, err := time.Parse("2006-01-02 15:04:05", startStr)
+	if err != nil {
+		return err
+	}
+
+	stop, err := time.Parse("2006-01-02 15:04:05", stopStr)
+	if err != nil {
+		return err
+	}
+
+	connClusterA, err := NewCHConn(clusterAConnectionString)
+	if err != nil {
+		return err
+	}
+
+	opts.Cluster = cluster
+	opts.FromConn = connClusterA
+	opts.Start = start
+	opts.Stop = stop
+	opts.SkipFile = skipFile
+	return nil
+}
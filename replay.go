@@ -1,12 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"database/sql"
 	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,16 +19,117 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+type ReplayOptions struct {
+	FromConn *sql.DB `json:"-"`
+	ToConn   *sql.DB `json:"-"`
+	// CompareConns are additional targets every query is replayed on at the
+	// same time as on ToConn, for A/B comparisons
+	CompareConns []*sql.DB `json:"-"`
+	VerifyConn   *sql.DB   `json:"-"`
+	Cluster      string    `json:"cluster"`
+	Start        time.Time `json:"start"`
+	Stop         time.Time `json:"stop"`
+	SkipFile     string    `json:"skip_file"`
+	AllowFile    string    `json:"allow_file"`
+	FromFile     string    `json:"from_file"`
+	Workers      int       `json:"workers"`
+	MaxInFlight  int       `json:"max_in_flight"`
+	MaxOpenConns int       `json:"max_open_conns"`
+	MaxIdleConns int       `json:"max_idle_conns"`
+
+	// RunDir holds the run's workload, results, summary and checkpoint
+	RunDir string `json:"run_dir"`
+	// WorkloadFile is the workload being replayed, either FromFile or the
+	// queries captured into RunDir
+	WorkloadFile string `json:"workload_file"`
+	// Resume continues the replay recorded in RunDir
+	Resume bool `json:"-"`
+	// RunID is sent as the log_comment of every replayed query and prefixes
+	// their query_id so the run's metrics can be found in the target's query log
+	RunID      string    `json:"run_id"`
+	RunStarted time.Time `json:"run_started"`
+	// CompareTargets is the number of CompareConns the run was started
+	// with, a resumed run needs the same number
+	CompareTargets int `json:"compare_targets"`
+	// TargetCluster, when set, makes metrics be harvested from all replicas
+	// of the target instead of the node the connection lands on
+	TargetCluster string `json:"target_cluster"`
+
+	// Sinks are the result sinks written besides output.csv, see resultSinks
+	Sinks []string `json:"sinks"`
+	// ResultsConn is the cluster the clickhouse sink inserts ResultsTable into
+	ResultsConn  *sql.DB `json:"-"`
+	ResultsTable string  `json:"results_table"`
+
+	// Progress follows the running replay, it is logged every
+	// ProgressInterval and served as Prometheus metrics on MetricsAddr
+	Progress         *replayProgress `json:"-"`
+	ProgressInterval time.Duration   `json:"-"`
+	MetricsAddr      string          `json:"-"`
+
+	Kinds    []string         `json:"kinds"`
+	Sampling WorkloadSampling `json:"sampling"`
+	// ShadowDatabase receives the writes of replayed inserts on the target
+	ShadowDatabase string `json:"shadow_database"`
+
+	RewriteRulesFile string `json:"rewrite_rules_file"`
+	// NoDefaultRewrites turns off defaultRewriteRules
+	NoDefaultRewrites bool           `json:"no_default_rewrites"`
+	Rewriter          *queryRewriter `json:"-"`
+
+	// LoadStages switch the replay to closed-loop mode, see runClosedLoop
+	LoadStages []LoadStage `json:"load_stages"`
+
+	// SettingsSets are replayed one after the other, each applying its
+	// settings to every query
+	SettingsSets []SettingsSet `json:"settings_sets"`
+
+	Speed            float64 `json:"speed"`
+	AsFastAsPossible bool    `json:"as_fast_as_possible"`
+
+	// Verify runs every query on VerifyConn as well and compares the results
+	Verify bool `json:"verify"`
+
+	// ReadOnly replays with readonly=2 and rejects every statement but
+	// SELECT before it reaches the targets
+	ReadOnly bool `json:"read_only"`
+
+	Gate        GateThresholds `json:"gate"`
+	VerdictFile string         `json:"verdict_file"`
+}
+
 type Query struct {
-	queryKind       string
-	query           string
-	queryStartTime  time.Time
-	queryDurationMs uint64
+	queryKind           string
+	query               string
+	queryStartTime      time.Time
+	queryDurationMs     uint64
+	normalizedQueryHash uint64
+
+	// settingsSet names the settings the query is replayed with
+	settingsSet string
+	settings    clickhouse.Settings
+	// offset is the position of the query in the workload file
+	offset  int64
+	queryID string
+	// sourceMetrics are the server-side metrics of the original execution
+	sourceMetrics QueryMetrics
+	// stage is the 1-based load stage of a closed-loop replay, 0 otherwise
+	stage int
+	// done, when set, is signalled once the query's result was handed on
+	done chan<- struct{}
 }
 
 type QueryResult struct {
-	queryKind          string
-	query              string
+	queryKind           string
+	query               string
+	normalizedQueryHash uint64
+	settingsSet         string
+	stage               int
+	offset              int64
+	// cancelled results belong to queries that were never run or were
+	// killed because the replay was interrupted, they aren't written
+	cancelled          bool
+	queryID            string
 	originalStartTime  time.Time
 	originalDurationMs uint64
 	replayStartTime    time.Time
@@ -33,343 +137,987 @@ type QueryResult struct {
 	deltaMs            int64
 	queryErrored       bool
 	errorStr           string
+	// rewrites lists the rewrite rules that changed the query
+	rewrites []string
+	// server-side metrics of the original execution and of the replay, the
+	// latter are harvested from the target's query log after the run
+	sourceMetrics QueryMetrics
+	targetMetrics QueryMetrics
+	// compared holds the replays on the CompareConns
+	compared []comparedReplay
+
+	// Populated when the replay runs in verify mode
+	verified         bool
+	rowCount         uint64
+	resultHash       uint64
+	sourceRowCount   uint64
+	sourceResultHash uint64
+	resultMismatch   bool
+	verifyErrorStr   string
+}
+
+// worker replays queries on the target. Queries run detached from ctx so
+// that an interruption doesn't just drop the connection and leave them
+// running on the server, instead they are killed by query_id.
+func worker(ctx context.Context, id int, opts *ReplayOptions, inFlight chan struct{}, running *runningQueries, queries <-chan Query, results chan<- QueryResult) {
+	log.Info("Starting worker: ", id)
+	for q := range queries {
+		var rewrites []string
+		// Block until a query slot is free so that the number of
+		// concurrently running queries never exceeds --max-in-flight
+		inFlight <- struct{}{}
+		// register before checking for cancellation so that a query is
+		// either never started or seen by killRunning
+		running.start(q.queryID)
+		if ctx.Err() != nil {
+			running.finish(q.queryID)
+			<-inFlight
+			sendResult(results, q, QueryResult{offset: q.offset, cancelled: true})
+			continue
+		}
+		queryErrored := false
+		errorStr := ""
+		originalQuery := q.query
+		q.query, rewrites = opts.Rewriter.rewrite(q.query)
+		if opts.ReadOnly {
+			// checked after rewriting since rewrite rules change the statement
+			if err := checkReadOnly(q.query); err != nil {
+				running.finish(q.queryID)
+				<-inFlight
+				log.Warnf("%v: %s", err, truncateQuery(q.query, 200))
+				sendResult(results, q, QueryResult{
+					queryKind:           q.queryKind,
+					normalizedQueryHash: q.normalizedQueryHash,
+					settingsSet:         q.settingsSet,
+					stage:               q.stage,
+					offset:              q.offset,
+					queryID:             q.queryID,
+					originalStartTime:   q.queryStartTime,
+					originalDurationMs:  q.queryDurationMs,
+					replayStartTime:     time.Now(),
+					queryErrored:        true,
+					errorStr:            err.Error(),
+					query:               q.query,
+					rewrites:            rewrites,
+					sourceMetrics:       q.sourceMetrics,
+				})
+				continue
+			}
+		}
+		log.Println("worker", id, "started  job", q)
+		// Only selects are verified, running an insert on the source would write to it
+		verify := opts.Verify && q.queryKind == "Select"
+		queryOptions := []clickhouse.QueryOption{clickhouse.WithQueryID(q.queryID)}
+		if len(q.settings) > 0 {
+			queryOptions = append(queryOptions, clickhouse.WithSettings(q.settings))
+		}
+		queryCtx := clickhouse.Context(context.WithoutCancel(ctx), queryOptions...)
+		run, compareRuns := runOnTargets(queryCtx, opts.ToConn, opts.CompareConns, q.query, verify)
+		running.finish(q.queryID)
+		<-inFlight
+		err := run.err
+		if err != nil && ctx.Err() != nil {
+			// killed because the replay was interrupted, it is replayed again on resume
+			sendResult(results, q, QueryResult{offset: q.offset, cancelled: true})
+			continue
+		}
+		if err != nil {
+			log.Warn(err)
+			queryErrored = true
+			errorStr = err.Error()
+		}
+		queryResult := QueryResult{
+			queryKind:           q.queryKind,
+			normalizedQueryHash: q.normalizedQueryHash,
+			settingsSet:         q.settingsSet,
+			stage:               q.stage,
+			offset:              q.offset,
+			queryID:             q.queryID,
+			originalStartTime:   q.queryStartTime,
+			originalDurationMs:  q.queryDurationMs,
+			replayStartTime:     run.start,
+			replayDurationMs:    run.durationMs(),
+			deltaMs:             int64(q.queryDurationMs) - int64(run.durationMs()),
+			queryErrored:        queryErrored,
+			errorStr:            errorStr,
+			query:               q.query,
+			rowCount:            run.rowCount,
+			resultHash:          run.resultHash,
+			rewrites:            rewrites,
+			sourceMetrics:       q.sourceMetrics,
+		}
+		for i, compareRun := range compareRuns {
+			c := comparedReplay{
+				replayDurationMs: compareRun.durationMs(),
+				rowCount:         compareRun.rowCount,
+				resultHash:       compareRun.resultHash,
+			}
+			if compareRun.err != nil {
+				log.Warnf("%s: %v", compareTargetName(i), compareRun.err)
+				c.queryErrored = true
+				c.errorStr = compareRun.err.Error()
+			}
+			queryResult.compared = append(queryResult.compared, c)
+		}
+		if verify && ctx.Err() == nil {
+			// the source runs outside of the timed section so it doesn't skew replay durations
+			verifyResult(ctx, opts.VerifyConn, originalQuery, &queryResult)
+			if queryResult.resultMismatch {
+				log.Warnf("Result mismatch: target returned %d rows (hash %d), source returned %d rows (hash %d) for query %s",
+					queryResult.rowCount, queryResult.resultHash, queryResult.sourceRowCount, queryResult.sourceResultHash, q.query)
+			}
+		}
+		sendResult(results, q, queryResult)
+	}
+}
+
+// sendResult hands a result to the csv writer and signals whoever issued
+// the query that it completed
+func sendResult(results chan<- QueryResult, q Query, r QueryResult) {
+	results <- r
+	if q.done != nil {
+		q.done <- struct{}{}
+	}
+}
+
+// resultsHeader lists the columns of output.csv, which depend on the
+// number of additional targets replayed on
+func resultsHeader(compareTargets int) []string {
+	header := append([]string{}, resultColumns...)
+	header = append(header, compareColumns(compareTargets)...)
+	return append(header, "rewrites", "query")
+}
+
+// resultColumns are the columns of output.csv up to the additional targets
+var resultColumns = []string{
+	"number",
+	"settings_set",
+	"stage",
+	"normalized_query_hash",
+	"original_start_time",
+	"original_duration_ms",
+	"replay_start_time",
+	"replay_duration_ms",
+	"delta_ms",
+	"query_errored",
+	"error",
+	"verified",
+	"result_rows",
+	"result_hash",
+	"source_result_rows",
+	"source_result_hash",
+	"result_mismatch",
+	"verify_error",
+	"query_id",
+	"source_read_rows",
+	"source_read_bytes",
+	"source_memory_usage",
+	"source_profile_events",
+	"target_read_rows",
+	"target_read_bytes",
+	"target_memory_usage",
+	"target_duration_ms",
+	"target_profile_events",
+}
+
+// resultRecord encodes a query result as a row of output.csv
+func resultRecord(number int, r QueryResult) []string {
+	record := []string{
+		strconv.Itoa(number),
+		r.settingsSet,
+		strconv.Itoa(r.stage),
+		strconv.FormatUint(r.normalizedQueryHash, 10),
+		r.originalStartTime.Format(time.RFC3339Nano),
+		strconv.FormatUint(r.originalDurationMs, 10),
+		r.replayStartTime.Format(time.RFC3339Nano),
+		strconv.FormatUint(r.replayDurationMs, 10),
+		strconv.FormatInt(r.deltaMs, 10),
+		strconv.FormatBool(r.queryErrored),
+		r.errorStr,
+		strconv.FormatBool(r.verified),
+		strconv.FormatUint(r.rowCount, 10),
+		strconv.FormatUint(r.resultHash, 10),
+		strconv.FormatUint(r.sourceRowCount, 10),
+		strconv.FormatUint(r.sourceResultHash, 10),
+		strconv.FormatBool(r.resultMismatch),
+		r.verifyErrorStr,
+		r.queryID,
+		strconv.FormatUint(r.sourceMetrics.ReadRows, 10),
+		strconv.FormatUint(r.sourceMetrics.ReadBytes, 10),
+		strconv.FormatUint(r.sourceMetrics.MemoryUsage, 10),
+		formatProfileEvents(r.sourceMetrics.ProfileEvents),
+		strconv.FormatUint(r.targetMetrics.ReadRows, 10),
+		strconv.FormatUint(r.targetMetrics.ReadBytes, 10),
+		strconv.FormatUint(r.targetMetrics.MemoryUsage, 10),
+		strconv.FormatUint(r.targetMetrics.DurationMs, 10),
+		formatProfileEvents(r.targetMetrics.ProfileEvents),
+	}
+	record = append(record, compareRecord(r)...)
+	return append(record, strings.Join(r.rewrites, ";"), r.query)
 }
 
-func loadSkipQueries(file string) ([]string, error) {
-	var skipQueries []string
-	f, err := os.Open(file)
+// parseResultRecord decodes a row of output.csv. Columns are looked up by
+// name so that results written by older versions, which lack some of the
+// columns, can still be read.
+func parseResultRecord(columns map[string]int, record []string) (QueryResult, error) {
+	var (
+		r   QueryResult
+		err error
+	)
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	parseUint := func(name string) uint64 {
+		if err != nil || field(name) == "" {
+			return 0
+		}
+		var v uint64
+		v, err = strconv.ParseUint(field(name), 10, 64)
+		return v
+	}
+	parseBool := func(name string) bool {
+		if err != nil || field(name) == "" {
+			return false
+		}
+		var v bool
+		v, err = strconv.ParseBool(field(name))
+		return v
+	}
+	parseEvents := func(name string) map[string]uint64 {
+		if err != nil {
+			return nil
+		}
+		var v map[string]uint64
+		v, err = parseProfileEvents(field(name))
+		return v
+	}
+	parseTime := func(name string) time.Time {
+		if err != nil || field(name) == "" {
+			return time.Time{}
+		}
+		var v time.Time
+		v, err = time.Parse(time.RFC3339Nano, field(name))
+		return v
+	}
+
+	r.settingsSet = field("settings_set")
+	r.stage = int(parseUint("stage"))
+	r.normalizedQueryHash = parseUint("normalized_query_hash")
+	r.originalStartTime = parseTime("original_start_time")
+	r.originalDurationMs = parseUint("original_duration_ms")
+	r.replayStartTime = parseTime("replay_start_time")
+	r.replayDurationMs = parseUint("replay_duration_ms")
+	r.deltaMs = int64(r.originalDurationMs) - int64(r.replayDurationMs)
+	r.queryErrored = parseBool("query_errored")
+	r.errorStr = field("error")
+	r.verified = parseBool("verified")
+	r.rowCount = parseUint("result_rows")
+	r.resultHash = parseUint("result_hash")
+	r.sourceRowCount = parseUint("source_result_rows")
+	r.sourceResultHash = parseUint("source_result_hash")
+	r.resultMismatch = parseBool("result_mismatch")
+	r.verifyErrorStr = field("verify_error")
+	r.queryID = field("query_id")
+	r.sourceMetrics = QueryMetrics{
+		ReadRows:      parseUint("source_read_rows"),
+		ReadBytes:     parseUint("source_read_bytes"),
+		MemoryUsage:   parseUint("source_memory_usage"),
+		ProfileEvents: parseEvents("source_profile_events"),
+	}
+	r.targetMetrics = QueryMetrics{
+		ReadRows:      parseUint("target_read_rows"),
+		ReadBytes:     parseUint("target_read_bytes"),
+		MemoryUsage:   parseUint("target_memory_usage"),
+		DurationMs:    parseUint("target_duration_ms"),
+		ProfileEvents: parseEvents("target_profile_events"),
+	}
+	if rewrites := field("rewrites"); rewrites != "" {
+		r.rewrites = strings.Split(rewrites, ";")
+	}
+	r.query = field("query")
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		return QueryResult{}, err
+	}
+	if r.compared, err = parseCompared(columns, record); err != nil {
+		return QueryResult{}, err
 	}
-	defer f.Close()
+	if _, ok := columns["normalized_query_hash"]; !ok {
+		// results from before the hash was recorded are grouped by query text
+		r.normalizedQueryHash = queryTextHash(r.query)
+	}
+	return r, nil
+}
 
-	scanner := bufio.NewScanner(f)
-	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		// Split on semicolons instead of newlines
-		for i := 0; i < len(data); i++ {
-			if data[i] == ';' {
-				return i + 1, data[:i], nil
-			}
+// readResults reads all query results of an output.csv file
+func readResults(path string) ([]QueryResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening results: %v", err)
+	}
+	defer file.Close()
+
+	r := csv.NewReader(file)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading results header of %s: %v", path, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+
+	var results []QueryResult
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading results of %s: %v", path, err)
 		}
-		if atEOF && len(data) > 0 {
-			return len(data), data, nil
+		result, err := parseResultRecord(columns, record)
+		if err != nil {
+			return nil, fmt.Errorf("parsing results of %s: %v", path, err)
 		}
-		return 0, nil, nil
-	})
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// replayClock maps wall-clock time onto the timeline of the captured
+// workload. A speed of 2 replays the workload twice as fast as it
+// originally ran, a speed of 0.5 at half speed.
+type replayClock struct {
+	origin  time.Time
+	started time.Time
+	speed   float64
+}
 
-	for scanner.Scan() {
-		query := scanner.Text()
-		query = strings.TrimSpace(query)
-		query = strings.ReplaceAll(query, "\n", " ")
-		skipQueries = append(skipQueries, query)
+func newReplayClock(origin, started time.Time, speed float64) *replayClock {
+	return &replayClock{
+		origin:  origin,
+		started: started,
+		speed:   speed,
 	}
-	if err := scanner.Err(); err != nil {
-		log.Error(err)
-		return nil, err
+}
+
+// virtualTime returns the point in the original timeline that corresponds to now
+func (c *replayClock) virtualTime(now time.Time) time.Time {
+	elapsed := float64(now.Sub(c.started)) * c.speed
+	return c.origin.Add(time.Duration(elapsed))
+}
+
+func (opts *ReplayOptions) runPath(name string) string {
+	return filepath.Join(opts.RunDir, name)
+}
+
+// loadRunConfig reads the options of the replay recorded in runDir
+func loadRunConfig(runDir string) (*ReplayOptions, error) {
+	data, err := os.ReadFile(filepath.Join(runDir, "run.json"))
+	if err != nil {
+		return nil, fmt.Errorf("reading run config: %v", err)
 	}
-	return skipQueries, nil
+	var opts ReplayOptions
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return nil, fmt.Errorf("parsing run config: %v", err)
+	}
+	opts.RunDir = runDir
+	opts.Resume = true
+	return &opts, nil
 }
 
-func buildQueryLogQuery(skipQueries []string) (string, error) {
-	skipQueriesStr := []string{}
-	for _, q := range skipQueries {
-		q = strings.TrimSpace(q)
-		q = strings.ReplaceAll(q, "\"", "\\\"")
-		q = strings.ReplaceAll(q, "'", "\\'")
-		q = strings.ReplaceAll(q, ";", "")
-		skipQueriesStr = append(skipQueriesStr, "query like '%"+q+"%'")
+func writeRunConfig(path string, opts *ReplayOptions) error {
+	data, err := json.MarshalIndent(opts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding run config: %v", err)
 	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing run config: %v", err)
+	}
+	return nil
+}
 
-	var skipQueriesPredicate string
-	if len(skipQueriesStr) == 0 {
-		skipQueriesPredicate = ""
-	} else {
-		skipQueriesPredicate = `and (` + strings.Join(skipQueriesStr, " or ") + `)`
+// buildWorkloadQuery builds the query that extracts the queries to replay
+// from the query log of every replica in the cluster, along with its query
+// parameters. Shapes in skipHashes are left out and, unless allowHashes is
+// nil, only the shapes in allowHashes are kept.
+func buildWorkloadQuery(opts *ReplayOptions, skipHashes, allowHashes []uint64) (string, []any) {
+	var skipHashQuery string
+	if allowHashes != nil {
+		skipHashQuery += `
+		and normalized_query_hash in (` + hashList(allowHashes) + `)`
+	}
+	if len(skipHashes) > 0 {
+		skipHashQuery += `
+		and normalized_query_hash not in (` + hashList(skipHashes) + `)`
+	}
+
+	sampling := opts.Sampling
+	filters, params := sampling.filters()
+	params = append([]any{
+		clickhouse.Named("cluster", opts.Cluster),
+		clickhouse.Named("kinds", arrayParam(opts.Kinds)),
+		clickhouse.Named("start", opts.Start.Format("2006-01-02 15:04:05")),
+		clickhouse.Named("stop", opts.Stop.Format("2006-01-02 15:04:05")),
+		profileEventsParam(),
+	}, params...)
+
+	// Inserts are narrowed down to INSERT ... SELECT by isReplayableInsert,
+	// this only avoids pulling plain inserts out of the query log
+	where := `
+		where type = 2 and is_initial_query = 1 and query_kind in {kinds:Array(String)}
+		and (query_kind != 'Insert' or positionCaseInsensitive(query, 'select') > 0)
+		and query_start_time >= {start:String} and query_start_time <= {stop:String}` + filters + skipHashQuery
+
+	var samplingQuery string
+	if sampling.sampling() {
+		samplingQuery += `
+		and ` + sampling.sampleKey() + ` % 10000 < {sample:UInt64}`
+		params = append(params, clickhouse.Named("sample", sampling.samplePermyriad()))
+	}
+	if sampling.TopShapes > 0 {
+		samplingQuery += `
+		and normalized_query_hash in (
+			select normalized_query_hash
+			from clusterAllReplicas({cluster:String}, system.query_log)` + strings.ReplaceAll(where, "\n\t\t", "\n\t\t\t") + `
+			group by normalized_query_hash
+			order by sum(query_duration_ms) desc, normalized_query_hash
+			limit {top_shapes:UInt64}
+		)`
+		params = append(params, clickhouse.Named("top_shapes", strconv.Itoa(sampling.TopShapes)))
 	}
 
 	query := `
-select normalized_query_hash from system.query_log
-where type = 2 and is_initial_query = 1 and query_kind = 'Select'
-and query_start_time >= {start:String} and query_start_time <= {stop:String}
-` + skipQueriesPredicate + `
-group by normalized_query_hash
-`
-
-	log.Info("Query Log Query", query)
-	return query, nil
+		select query_kind, query, query_start_time_microseconds, query_duration_ms, normalized_query_hash,
+			any(read_rows) as source_read_rows, any(read_bytes) as source_read_bytes,
+			any(memory_usage) as source_memory_usage, any(` + profileEventsExpr + `) as source_profile_events
+		from clusterAllReplicas({cluster:String}, system.query_log)` + where + samplingQuery + `
+		group by query, query_start_time_microseconds, query_duration_ms, query_kind, normalized_query_hash`
+
+	if sampling.MaxPerShape > 0 {
+		query += `
+		order by normalized_query_hash, ` + sampling.sampleKey() + `
+		limit {max_per_shape:UInt64} by normalized_query_hash`
+		params = append(params, clickhouse.Named("max_per_shape", strconv.Itoa(sampling.MaxPerShape)))
+		query = `
+		select * from (` + query + `
+		)`
+	}
+	if sampling.usesSeed() {
+		params = append(params, sampling.seedParam())
+	}
+
+	return query + `
+		order by query_start_time_microseconds asc
+		`, params
 }
 
-func getSkipQueryHashes(querySkipFile string, start, stop time.Time, conn *sql.DB) ([]uint64, error) {
-	var skipQueryHashes []uint64
+// captureQueryHistory extracts the queries to replay from the source
+// cluster's query log and writes them to a workload file at path
+func captureQueryHistory(ctx context.Context, opts *ReplayOptions, path string) error {
+	if err := validateKinds(opts.Kinds); err != nil {
+		return err
+	}
+	if err := opts.Sampling.validate(); err != nil {
+		return err
+	}
 
-	skipQueries, err := loadSkipQueries(querySkipFile)
-	if err != nil {
-		log.Error(err)
-		return nil, err
+	var skipHashes, allowHashes []uint64
+	if opts.SkipFile != "" {
+		var err error
+		skipHashes, err = resolveQueryFilters(ctx, opts, opts.SkipFile)
+		if err != nil {
+			return err
+		}
+		log.Infof("Skipping %d query shapes matched by %s", len(skipHashes), opts.SkipFile)
 	}
+	if opts.AllowFile != "" {
+		var err error
+		allowHashes, err = resolveQueryFilters(ctx, opts, opts.AllowFile)
+		if err != nil {
+			return err
+		}
+		if len(allowHashes) == 0 {
+			return fmt.Errorf("no query shapes in the capture window match %s", opts.AllowFile)
+		}
+		log.Infof("Only capturing the %d query shapes matched by %s", len(allowHashes), opts.AllowFile)
+	}
+
+	query, params := buildWorkloadQuery(opts, skipHashes, allowHashes)
 
-	query, err := buildQueryLogQuery(skipQueries)
+	log.Infof("Capturing query history from %s to %s into %s", opts.Start.Format("2006-01-02"), opts.Stop.Format("2006-01-02"), path)
+	rows, err := opts.FromConn.QueryContext(ctx, query, params...)
 	if err != nil {
-		log.Error(err)
-		return nil, err
+		return fmt.Errorf("querying query log: %v", err)
 	}
+	defer rows.Close()
 
-	rows, err := conn.QueryContext(
-		context.Background(),
-		query,
-		clickhouse.Named("start", start.Format("2006-01-02")),
-		clickhouse.Named("stop", stop.Format("2006-01-02")))
+	// Create a new CSV file
+	file, err := os.Create(path)
 	if err != nil {
-		log.Error(err, query)
-		return nil, err
+		return fmt.Errorf("creating workload file: %v", err)
 	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+
+	captured := 0
 	for rows.Next() {
-		var (
-			queryHash uint64
-		)
+		var q Query
 		if err := rows.Scan(
-			&queryHash,
+			&q.queryKind,
+			&q.query,
+			&q.queryStartTime,
+			&q.queryDurationMs,
+			&q.normalizedQueryHash,
+			&q.sourceMetrics.ReadRows,
+			&q.sourceMetrics.ReadBytes,
+			&q.sourceMetrics.MemoryUsage,
+			&q.sourceMetrics.ProfileEvents,
 		); err != nil {
-			log.Error(err)
-			return nil, err
+			log.Warn(err)
+			continue
+		}
+		if q.queryKind == "Insert" && !isReplayableInsert(q.query) {
+			continue
+		}
+
+		if err := writer.Write(queryRecord(q)); err != nil {
+			return fmt.Errorf("writing workload file: %v", err)
 		}
-		skipQueryHashes = append(skipQueryHashes, queryHash)
+		captured++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading query log: %v", err)
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("writing workload file: %v", err)
 	}
-	return skipQueryHashes, nil
+	log.Infof("Captured %d queries into %s", captured, path)
+	return nil
 }
 
-func worker(id int, toConn *sql.DB, queries <-chan Query, results chan<- QueryResult) {
-	log.Info("Starting worker: ", id)
-	ctx := context.Background()
-	for q := range queries {
-		start := time.Now()
-		queryErrored := false
-		errorStr := ""
-		// This is a hack to remove the allow_experimental_object_type=1 from the query
-		// this is not allowed on clickhouse cloud
-		q.query = strings.ReplaceAll(q.query, ", allow_experimental_object_type=1", " ")
-		log.Println("worker", id, "started  job", q)
-		_, err := toConn.ExecContext(ctx, q.query)
+// queryRecord encodes a query as a row of a workload file
+func queryRecord(q Query) []string {
+	return []string{
+		q.queryKind,
+		q.query,
+		q.queryStartTime.Format(time.RFC3339Nano),
+		strconv.FormatUint(q.queryDurationMs, 10),
+		strconv.FormatUint(q.normalizedQueryHash, 10),
+		strconv.FormatUint(q.sourceMetrics.ReadRows, 10),
+		strconv.FormatUint(q.sourceMetrics.ReadBytes, 10),
+		strconv.FormatUint(q.sourceMetrics.MemoryUsage, 10),
+		formatProfileEvents(q.sourceMetrics.ProfileEvents),
+	}
+}
+
+// parseQueryRecord decodes a row of a workload file
+func parseQueryRecord(record []string) (Query, error) {
+	if len(record) < 4 {
+		return Query{}, fmt.Errorf("expected at least 4 fields in workload record, got %d", len(record))
+	}
+	queryStartTime, err := time.Parse(time.RFC3339Nano, record[2])
+	if err != nil {
+		return Query{}, fmt.Errorf("parsing query start time: %v", err)
+	}
+	queryDurationMs, err := strconv.ParseUint(record[3], 10, 64)
+	if err != nil {
+		return Query{}, fmt.Errorf("parsing query duration: %v", err)
+	}
+	// Workload files captured before the normalized query hash was recorded
+	// fall back to a hash of the query text
+	var normalizedQueryHash uint64
+	if len(record) > 4 {
+		normalizedQueryHash, err = strconv.ParseUint(record[4], 10, 64)
 		if err != nil {
-			log.Warn(err)
-			queryErrored = true
-			errorStr = err.Error()
+			return Query{}, fmt.Errorf("parsing normalized query hash: %v", err)
+		}
+	} else {
+		normalizedQueryHash = queryTextHash(record[1])
+	}
+	// Source metrics were added later still and are left empty for older files
+	var sourceMetrics QueryMetrics
+	if len(record) > 8 {
+		values := make([]uint64, 3)
+		for i := range values {
+			values[i], err = strconv.ParseUint(record[5+i], 10, 64)
+			if err != nil {
+				return Query{}, fmt.Errorf("parsing source metrics: %v", err)
+			}
+		}
+		sourceMetrics.ReadRows, sourceMetrics.ReadBytes, sourceMetrics.MemoryUsage = values[0], values[1], values[2]
+		sourceMetrics.ProfileEvents, err = parseProfileEvents(record[8])
+		if err != nil {
+			return Query{}, err
 		}
-		end := time.Now()
-		queryResult := QueryResult{
-			queryKind:          q.queryKind,
-			originalStartTime:  q.queryStartTime,
-			originalDurationMs: q.queryDurationMs,
-			replayStartTime:    start,
-			replayDurationMs:   uint64(end.Sub(start).Milliseconds()),
-			deltaMs:            int64(q.queryDurationMs) - int64(end.Sub(start).Milliseconds()),
-			queryErrored:       queryErrored,
-			errorStr:           errorStr,
-			query:              q.query,
-		}
-		results <- queryResult
 	}
+	return Query{
+		queryKind:           record[0],
+		query:               record[1],
+		queryStartTime:      queryStartTime,
+		queryDurationMs:     queryDurationMs,
+		normalizedQueryHash: normalizedQueryHash,
+		sourceMetrics:       sourceMetrics,
+	}, nil
 }
 
-func csvWriter(results <-chan QueryResult, wg *sync.WaitGroup) {
-	log.Info("Starting CSV writer")
+// queryTextHash stands in for the normalized query hash when it wasn't recorded
+func queryTextHash(query string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(query))
+	return h.Sum64()
+}
 
-	i := 0
+func replayQueryHistory(ctx context.Context, opts *ReplayOptions) error {
+	if opts.Workers <= 0 {
+		return fmt.Errorf("number of workers must be positive, got %d", opts.Workers)
+	}
+	if opts.MaxInFlight <= 0 || opts.MaxInFlight > opts.Workers {
+		opts.MaxInFlight = opts.Workers
+	}
+	if opts.Speed <= 0 {
+		return fmt.Errorf("replay speed must be positive, got %v", opts.Speed)
+	}
+	if opts.Verify && opts.VerifyConn == nil {
+		return fmt.Errorf("verify mode needs a source connection to compare results against")
+	}
+	if err := validateKinds(opts.Kinds); err != nil {
+		return err
+	}
+	if opts.ReadOnly && includes(opts.Kinds, "Insert") {
+		log.Warn("Read-only mode rejects every insert of the workload, they are reported as errors")
+	}
+	if opts.Resume && len(opts.CompareConns) != opts.CompareTargets {
+		return fmt.Errorf("the replay being resumed compared %d additional targets, got %d", opts.CompareTargets, len(opts.CompareConns))
+	}
+	opts.CompareTargets = len(opts.CompareConns)
+	if opts.Resume && len(opts.LoadStages) > 0 {
+		return fmt.Errorf("closed-loop replays can't be resumed")
+	}
+	for _, stage := range opts.LoadStages {
+		if stage.Users > opts.MaxInFlight {
+			log.Warnf("Stage with %d virtual users exceeds the %d queries allowed in flight, users will queue for a query slot", stage.Users, opts.MaxInFlight)
+		}
+	}
+	rewriter, err := replayRewriter(opts.RewriteRulesFile, !opts.NoDefaultRewrites)
+	if err != nil {
+		return err
+	}
+	opts.Rewriter = rewriter
+	if len(opts.SettingsSets) == 0 {
+		opts.SettingsSets = []SettingsSet{{Name: "default"}}
+	}
+	if includes(opts.Kinds, "Insert") && opts.ShadowDatabase == "" {
+		log.Warn("Replaying inserts without a shadow database, writes will go to the original tables on the target")
+	}
+	for _, conn := range append([]*sql.DB{opts.ToConn}, opts.CompareConns...) {
+		conn.SetMaxOpenConns(opts.MaxOpenConns)
+		conn.SetMaxIdleConns(opts.MaxIdleConns)
+	}
 
-	// Create a new CSV file
-	file, err := os.Create("output.csv")
+	if opts.RunDir == "" {
+		opts.RunDir = "."
+	}
+	if err := os.MkdirAll(opts.RunDir, 0755); err != nil {
+		return fmt.Errorf("creating run directory: %v", err)
+	}
+
+	var resume *replayCheckpoint
+	if opts.Resume {
+		var err error
+		resume, err = loadCheckpoint(opts.runPath("checkpoint.json"))
+		if err != nil {
+			return err
+		}
+		log.Infof("Resuming replay in %s from settings set %d, workload record %d, %d results written",
+			opts.RunDir, resume.SettingsSet, resume.Offset, resume.Results)
+	} else if opts.FromFile != "" {
+		opts.WorkloadFile = opts.FromFile
+	} else {
+		opts.WorkloadFile = opts.runPath("queries.csv")
+		if err := captureQueryHistory(ctx, opts, opts.WorkloadFile); err != nil {
+			return err
+		}
+	}
+	// run.json records the workload, the run may be resumed from another directory
+	workloadFile, err := filepath.Abs(opts.WorkloadFile)
 	if err != nil {
-		log.Fatalf("failed creating file: %s", err)
+		return fmt.Errorf("resolving workload file: %v", err)
 	}
-	defer file.Close()
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-	if err := writer.Write(
-		[]string{
-			"number",
-			"original_start_time",
-			"original_duration_ms",
-			"replay_start_time",
-			"replay_duration_ms",
-			"delta_ms",
-			"query_errored",
-			"error",
-			"query",
-		}); err != nil {
-		log.Fatalln("error writing record to csv:", err)
-		wg.Done()
-	}
-
-	// Write all the records
-	for r := range results {
-		i++
-		if err := writer.Write(
-			[]string{
-				strconv.Itoa(i),
-				r.originalStartTime.Format(time.RFC3339Nano),
-				strconv.FormatUint(r.originalDurationMs, 10),
-				r.replayStartTime.Format(time.RFC3339Nano),
-				strconv.FormatUint(r.replayDurationMs, 10),
-				strconv.FormatInt(r.deltaMs, 10),
-				strconv.FormatBool(r.queryErrored),
-				r.errorStr,
-				r.query,
-			}); err != nil {
-			log.Fatalln("error writing record to csv:", err)
-			wg.Done()
+	opts.WorkloadFile = workloadFile
+
+	if opts.RunStarted.IsZero() {
+		opts.RunStarted = time.Now()
+	}
+	if opts.RunID == "" {
+		opts.RunID = newRunID(opts.RunStarted)
+	}
+	log.Infof("Replay run id: %s", opts.RunID)
+
+	// progress is reported until the replay returns, even while it drains
+	progressCtx, stopProgress := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopProgress()
+	opts.Progress = newReplayProgress(opts.RunID)
+	if opts.ProgressInterval > 0 {
+		go reportProgress(progressCtx, opts.Progress, opts.ProgressInterval)
+	}
+	if opts.MetricsAddr != "" {
+		if err := serveMetrics(progressCtx, opts.MetricsAddr, opts.Progress); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Replay concurrency: workers=%d max_in_flight=%d max_open_conns=%d max_idle_conns=%d",
+		opts.Workers, opts.MaxInFlight, opts.MaxOpenConns, opts.MaxIdleConns)
+	if err := writeRunConfig(opts.runPath("run.json"), opts); err != nil {
+		return err
+	}
+
+	// sinks keep writing after an interrupt so that they get every result drained
+	sinks, err := openSinks(context.WithoutCancel(ctx), opts, resume)
+	if err != nil {
+		return err
+	}
+	sinks = append(sinks, progressSink{opts.Progress})
+	summary := newSummaryCollector()
+	summary.stages = opts.LoadStages
+	written := 0
+	if resume != nil {
+		// results written before the replay stopped count towards the summary
+		previous, err := readResults(opts.runPath("output.csv"))
+		if err != nil {
+			return err
 		}
-		writer.Flush()
-		// Check if there are any errors during write
-		if err := writer.Error(); err != nil {
-			log.Fatal(err)
+		for _, r := range previous {
+			summary.add(r)
 		}
-		wg.Done()
+		written = len(previous)
 	}
 
-}
+	// a failing output.csv stops the replay like an interrupt, with it as the cause
+	ctx, stopRun := context.WithCancelCause(ctx)
+	defer stopRun(nil)
 
-func replayQueryHistory(ctx context.Context, fromConn, toConn *sql.DB, cluster string, start, stop time.Time, skip_file string) error {
 	log.Info("Starting workers")
-	numWorkers := 1000
-
 	queries := make(chan Query)
 	results := make(chan QueryResult)
+	inFlight := make(chan struct{}, opts.MaxInFlight)
 	var wg sync.WaitGroup
-	for w := 1; w <= numWorkers; w++ {
-		go worker(w, toConn, queries, results)
+	running := newRunningQueries()
+	for w := 1; w <= opts.Workers; w++ {
+		go worker(ctx, w, opts, inFlight, running, queries, results)
+	}
+	drained := make(chan struct{})
+	for _, conn := range append([]*sql.DB{opts.ToConn}, opts.CompareConns...) {
+		go killRunning(ctx, conn, running, drained)
 	}
 
-	// start the csv writer
-	go csvWriter(results, &wg)
-
-	var skipHashQuery string
-
-	if skip_file != "" {
-		// load the skip queries
-		skipHashes, err := getSkipQueryHashes(skip_file, start, stop, fromConn)
+	// start the result writer
+	// closed-loop replays issue the same records many times so they aren't checkpointed
+	var (
+		tracker  *checkpointTracker
+		workload []Query
+	)
+	if len(opts.LoadStages) == 0 {
+		tracker = newCheckpointTracker(opts.runPath("checkpoint.json"), resume)
+	} else {
+		workload, err = loadWorkload(opts)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+	}
+	writerDone := make(chan struct{})
+	go resultWriter(sinks, results, summary, tracker, written, &wg, stopRun, writerDone)
 
-		skipHashesStr := []string{}
-		for _, h := range skipHashes {
-			skipHashesStr = append(skipHashesStr, strconv.FormatUint(h, 10))
+	for i, set := range opts.SettingsSets {
+		if resume != nil && i < resume.SettingsSet {
+			continue
+		}
+		log.Infof("Replaying workload from %s with settings set %s %v", opts.WorkloadFile, set.Name, set.Settings)
+		var err error
+		if workload != nil {
+			err = runClosedLoop(ctx, opts, i, workload, queries, &wg)
+		} else {
+			tracker.startSettingsSet(i)
+			err = dispatchWorkload(ctx, opts, i, resume, tracker, queries, &wg)
+		}
+		if err != nil && ctx.Err() == nil {
+			// stop like an interrupt so in-flight queries are killed and the
+			// results and checkpoint written so far are kept
+			log.Errorf("Stopping the replay: %v", err)
+			stopRun(err)
 		}
+		// let the settings set finish before starting the next one so runs don't overlap
+		wg.Wait()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(queries)
+	close(drained)
+	close(results)
+	<-writerDone
 
-		skipHashQuery = `and normalized_query_hash not in (` + strings.Join(skipHashesStr, `, `) + `)`
+	if ctx.Err() == nil {
+		metrics, err := harvestTargetMetrics(ctx, opts)
+		if err != nil {
+			log.Warnf("Server-side metrics of the replay are missing from output.csv: %v", err)
+		} else {
+			matched, err := annotateResults(opts.runPath("output.csv"), metrics, opts.CompareTargets)
+			if err != nil {
+				return err
+			}
+			log.Infof("Added target query log metrics to %d results", matched)
+		}
 	}
 
-	query := `
-		select query_kind, query, query_start_time_microseconds, query_duration_ms 
-		from clusterAllReplicas({cluster:String}, system.query_log)
-		where type = 2 and is_initial_query = 1 and query_kind = 'Select'
-		and query_start_time >= {start:String} and query_start_time <= {stop:String}
-		` + skipHashQuery + `
-		group by query, query_start_time_microseconds, query_duration_ms, query_kind
-		order by query_start_time_microseconds asc
-		`
-
-	log.Infof("Replaying query history from %s to %s", start.Format("2006-01-02"), stop.Format("2006-01-02"))
-	rows, err := fromConn.QueryContext(ctx,
-		query,
-		clickhouse.Named("cluster", cluster),
-		clickhouse.Named("start", start.Format("2006-01-02 15:04:05")),
-		clickhouse.Named("stop", stop.Format("2006-01-02 15:04:05")))
-	if err != nil {
-		log.Fatal(query, err)
+	replaySummary := summary.summary()
+	printSummary(os.Stdout, replaySummary)
+	if err := writeSummary(opts.runPath("summary.json"), replaySummary); err != nil {
+		return err
 	}
 
-	// Create a new CSV file
-	file, err := os.Create("queries.csv")
-	if err != nil {
-		log.Fatalf("failed creating file: %s", err)
+	if ctx.Err() != nil {
+		log.Warn("Replay interrupted, the summary only covers completed queries")
+		if len(opts.LoadStages) == 0 {
+			log.Warnf("Resume it with --resume %s", opts.RunDir)
+		}
+		return fmt.Errorf("replay interrupted: %w", context.Cause(ctx))
 	}
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
 
-	for rows.Next() {
-		var (
-			queryKind       string
-			query           string
-			queryStartTime  time.Time
-			queryDurationMs uint64
-		)
-		if err := rows.Scan(
-			&queryKind,
-			&query,
-			&queryStartTime,
-			&queryDurationMs,
-		); err != nil {
-			log.Warn(err)
+	if !opts.Gate.enabled() {
+		return nil
+	}
+	verdict := evaluateGate(replaySummary, opts.Gate)
+	if err := writeVerdict(opts.VerdictFile, verdict); err != nil {
+		return err
+	}
+	if !verdict.Passed {
+		for _, b := range verdict.Breaches {
+			log.Errorf("Threshold breached: %s %.4f > %.4f for query shape %d %s",
+				b.Metric, b.Value, b.Threshold, b.NormalizedQueryHash, truncateQuery(b.ExampleQuery, 80))
 		}
+		return errReplayGateFailed
+	}
+	log.Infof("Replay passed all regression thresholds, verdict written to %s", opts.VerdictFile)
+	return nil
+}
 
-		if err := writer.Write(
-			[]string{
-				queryKind,
-				query,
-				queryStartTime.Format(time.RFC3339Nano),
-				strconv.FormatUint(queryDurationMs, 10),
-			}); err != nil {
-			log.Fatalln("error writing record to csv:", err)
+// prepareQuery decodes a workload record and applies the replay options to
+// it. It returns false for records that aren't replayed.
+func prepareQuery(opts *ReplayOptions, record []string) (Query, bool) {
+	queryRow, err := parseQueryRecord(record)
+	if err != nil {
+		log.Warn(err)
+		return Query{}, false
+	}
+	if !includes(opts.Kinds, queryRow.queryKind) {
+		return Query{}, false
+	}
+	if queryRow.queryKind == "Insert" {
+		if !isReplayableInsert(queryRow.query) {
+			return Query{}, false
 		}
-		if err != nil {
-			log.Warn(err)
+		if opts.ShadowDatabase != "" {
+			queryRow.query, err = redirectInsert(queryRow.query, opts.ShadowDatabase)
+			if err != nil {
+				log.Warn(err)
+				return Query{}, false
+			}
 		}
+	}
+	return queryRow, true
+}
 
-		writer.Flush()
+// replaySettings are the settings queries of a settings set are replayed with
+func replaySettings(opts *ReplayOptions, set SettingsSet) clickhouse.Settings {
+	settings := set.clickhouseSettings()
+	settings["log_comment"] = opts.RunID
+	if opts.ReadOnly {
+		// readonly=1 would reject every query, since it forbids changing any
+		// setting and log_comment and the settings set are sent with each
+		// one. readonly=2 lets a query's own SETTINGS clause change settings
+		// too, but still forbids writes, DDL and changing readonly itself,
+		// and checkReadOnly only lets SELECTs through anyway.
+		settings["readonly"] = "2"
 	}
-	file.Close()
+	return settings
+}
 
-	file, err = os.OpenFile("queries.csv", os.O_RDONLY, os.ModePerm)
+// dispatchWorkload reads the workload file and hands its queries to the
+// workers at the time they are due, skipping records a resumed replay
+// already completed. It stops when ctx is cancelled.
+func dispatchWorkload(ctx context.Context, opts *ReplayOptions, settingsSet int, resume *replayCheckpoint, tracker *checkpointTracker, queries chan<- Query, wg *sync.WaitGroup) error {
+	file, err := os.Open(opts.WorkloadFile)
 	if err != nil {
-		log.Fatalf("failed opening file: %s", err)
+		return fmt.Errorf("opening workload file: %v", err)
 	}
 	defer file.Close()
 
+	set := opts.SettingsSets[settingsSet]
+	settings := replaySettings(opts, set)
 	r := csv.NewReader(file)
-	var tsOffset time.Duration
-	for {
+	var clock *replayClock
+	for offset := int64(0); ; offset++ {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
 			log.Warn(err)
+			tracker.skipped(offset)
+			continue
 		}
-		queryKind := record[0]
-		query := record[1]
-		queryStartTime, err := time.Parse(time.RFC3339Nano, record[2])
-		if err != nil {
-			log.Warn(err)
+		if resume.done(settingsSet, offset) {
+			tracker.skipped(offset)
+			continue
 		}
-		queryDurationMs, err := strconv.ParseUint(record[3], 10, 64)
-		if err != nil {
-			log.Warn(err)
-		}
-
-		queryRow := Query{
-			queryKind:       queryKind,
-			query:           query,
-			queryStartTime:  queryStartTime,
-			queryDurationMs: queryDurationMs,
+		queryRow, ok := prepareQuery(opts, record)
+		if !ok {
+			tracker.skipped(offset)
+			continue
 		}
-		if tsOffset == 0 {
-			// this is the first loop - set a few ts vars
-			tsOffset = time.Since(queryStartTime)
+		queryRow.offset = offset
+		queryRow.queryID = replayQueryID(opts.RunID, settingsSet, offset)
+		queryRow.settingsSet = set.Name
+		queryRow.settings = settings
+		var virtualTime time.Time
+		if !opts.AsFastAsPossible {
+			if clock == nil {
+				// this is the first loop - anchor the virtual timeline on the first query
+				clock = newReplayClock(queryRow.queryStartTime, time.Now(), opts.Speed)
+			}
+			for {
+				virtualTime = clock.virtualTime(time.Now())
+				if !queryRow.queryStartTime.After(virtualTime) {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(10 * time.Millisecond):
+				}
+			}
 		}
-		for {
-			virtualTime := time.Now().UTC().Add(-tsOffset)
-			log.Info("Virtual time: ", virtualTime, " Query start time: ", queryStartTime)
-			if queryStartTime.Before(virtualTime) {
-				wg.Add(1)
-				queries <- queryRow
-				break
+		wg.Add(1)
+		tracker.dispatched(offset)
+		select {
+		case queries <- queryRow:
+			if clock != nil {
+				// dispatching may have waited for a free worker
+				virtualTime = clock.virtualTime(time.Now())
 			}
-			time.Sleep(10 * time.Millisecond)
+			opts.Progress.dispatch(queryRow, virtualTime)
+		case <-ctx.Done():
+			// left outstanding in the checkpoint so a resume replays it
+			wg.Done()
+			return ctx.Err()
 		}
 	}
-	close(queries)
-	wg.Wait()
 	return nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// killTimeout bounds the KILL QUERY statements sent while a replay drains
+const killTimeout = 10 * time.Second
+
+// runningQueries tracks the query_id of every query running on the target
+// so that they can be killed when a replay is interrupted
+type runningQueries struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func newRunningQueries() *runningQueries {
+	return &runningQueries{ids: make(map[string]bool)}
+}
+
+func (r *runningQueries) start(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids[id] = true
+}
+
+func (r *runningQueries) finish(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ids, id)
+}
+
+func (r *runningQueries) list() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.ids))
+	for id := range r.ids {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// killRunning waits for ctx to be cancelled and then kills the queries
+// still running on the target until none are left or stop is closed.
+// Killing is repeated since a query may reach the server only after the
+// previous KILL was sent. KILL QUERY is the one statement besides SELECTs
+// read-only mode sends to the target.
+func killRunning(ctx context.Context, conn *sql.DB, running *runningQueries, stop <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+	case <-stop:
+		return
+	}
+	for {
+		ids := running.list()
+		if len(ids) > 0 {
+			log.Infof("Killing %d queries still running on the target", len(ids))
+			if err := killQueries(conn, ids); err != nil {
+				log.Warn(err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func killQueries(conn *sql.DB, ids []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+	// the ids are built by replayQueryID and safe to inline
+	query := fmt.Sprintf("KILL QUERY WHERE has(%s, query_id) ASYNC", arrayParam(ids))
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("killing running queries: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunningQueries(t *testing.T) {
+	running := newRunningQueries()
+	a := replayQueryID("run", 0, 1)
+	b := replayQueryID("run", 0, 2)
+	running.start(a)
+	running.start(b)
+	assert.ElementsMatch(t, []string{a, b}, running.list())
+
+	running.finish(a)
+	assert.Equal(t, []string{b}, running.list())
+	running.finish(b)
+	assert.Empty(t, running.list())
+}
+
+func TestDispatchWorkloadStopsWhenCancelled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.csv")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	w := csv.NewWriter(file)
+	start := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		w.Write(queryRecord(Query{queryKind: "Select", query: "SELECT 1", queryStartTime: start}))
+	}
+	w.Flush()
+	require.NoError(t, file.Close())
+
+	opts := &ReplayOptions{
+		WorkloadFile:     path,
+		Kinds:            []string{"Select"},
+		SettingsSets:     []SettingsSet{{Name: "default"}},
+		AsFastAsPossible: true,
+	}
+	tracker := newCheckpointTracker(filepath.Join(t.TempDir(), "checkpoint.json"), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	queries := make(chan Query)
+	var wg sync.WaitGroup
+
+	go func() {
+		// take the first query, then interrupt while the second waits for a worker
+		q := <-queries
+		assert.Equal(t, int64(0), q.offset)
+		cancel()
+	}()
+	err = dispatchWorkload(ctx, opts, 0, nil, tracker, queries, &wg)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// the first query was dispatched and never finished, so it is replayed on resume
+	assert.Equal(t, int64(0), tracker.checkpoint(0, nil).Offset)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// checkpointInterval is how often the replay progress is persisted
+const checkpointInterval = time.Second
+
+// replayCheckpoint records how far a replay got so that it can be resumed.
+// Workload records are identified by their offset in the workload file.
+type replayCheckpoint struct {
+	// SettingsSet is the index of the settings set being replayed
+	SettingsSet int `json:"settings_set"`
+	// Offset is the first workload record that may not have completed yet,
+	// every record before it has completed or was skipped
+	Offset int64 `json:"offset"`
+	// CompletedAfter lists records past Offset that already completed
+	CompletedAfter []int64 `json:"completed_after"`
+	// Results is the number of rows written to output.csv and SinkBytes
+	// the size of each result file when the checkpoint was taken. Rows
+	// written after the checkpoint are dropped on resume since their
+	// queries are replayed again.
+	Results   int              `json:"results"`
+	SinkBytes map[string]int64 `json:"sink_bytes"`
+	// DroppedSinks are the optional sinks dropped after failing, a resumed
+	// replay doesn't reopen them
+	DroppedSinks []string `json:"dropped_sinks,omitempty"`
+}
+
+// done reports whether the record at offset of the given settings set
+// completed before the checkpoint was taken
+func (c *replayCheckpoint) done(settingsSet int, offset int64) bool {
+	if c == nil {
+		return false
+	}
+	if settingsSet != c.SettingsSet {
+		return settingsSet < c.SettingsSet
+	}
+	if offset < c.Offset {
+		return true
+	}
+	i := sort.Search(len(c.CompletedAfter), func(i int) bool { return c.CompletedAfter[i] >= offset })
+	return i < len(c.CompletedAfter) && c.CompletedAfter[i] == offset
+}
+
+func loadCheckpoint(path string) (*replayCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint: %v", err)
+	}
+	var c replayCheckpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing checkpoint: %v", err)
+	}
+	return &c, nil
+}
+
+// checkpointTracker follows which workload records have been dispatched
+// and completed and periodically persists a checkpoint
+type checkpointTracker struct {
+	path string
+
+	mu          sync.Mutex
+	settingsSet int
+	next        int64
+	outstanding map[int64]bool
+	completed   map[int64]bool
+	lastSaved   time.Time
+	dropped     []string
+}
+
+func newCheckpointTracker(path string, resume *replayCheckpoint) *checkpointTracker {
+	t := &checkpointTracker{
+		path:        path,
+		outstanding: make(map[int64]bool),
+		completed:   make(map[int64]bool),
+	}
+	if resume != nil {
+		t.settingsSet = resume.SettingsSet
+		t.next = resume.Offset
+		for _, offset := range resume.CompletedAfter {
+			t.completed[offset] = true
+		}
+		t.dropped = resume.DroppedSinks
+	}
+	return t
+}
+
+// dropSinks records sinks dropped after failing
+func (t *checkpointTracker) dropSinks(sinks []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, sink := range sinks {
+		if !includes(t.dropped, sink) {
+			t.dropped = append(t.dropped, sink)
+		}
+	}
+}
+
+// startSettingsSet resets the tracker for the next settings set
+func (t *checkpointTracker) startSettingsSet(settingsSet int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if settingsSet == t.settingsSet {
+		return
+	}
+	t.settingsSet = settingsSet
+	t.next = 0
+	t.outstanding = make(map[int64]bool)
+	t.completed = make(map[int64]bool)
+}
+
+// dispatched marks the record at offset as handed to a worker
+func (t *checkpointTracker) dispatched(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.outstanding[offset] = true
+	t.next = offset + 1
+}
+
+// skipped marks the record at offset as not needing a replay
+func (t *checkpointTracker) skipped(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.completed[offset] = true
+	t.next = offset + 1
+}
+
+// finished marks the record at offset as completed
+func (t *checkpointTracker) finished(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.outstanding, offset)
+	t.completed[offset] = true
+}
+
+func (t *checkpointTracker) checkpoint(results int, sinkBytes map[string]int64) replayCheckpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lowWaterMark := t.next
+	for offset := range t.outstanding {
+		lowWaterMark = min(lowWaterMark, offset)
+	}
+	c := replayCheckpoint{
+		SettingsSet:    t.settingsSet,
+		Offset:         lowWaterMark,
+		CompletedAfter: []int64{},
+		Results:        results,
+		SinkBytes:      sinkBytes,
+		DroppedSinks:   t.dropped,
+	}
+	for offset := range t.completed {
+		if offset < lowWaterMark {
+			delete(t.completed, offset)
+			continue
+		}
+		c.CompletedAfter = append(c.CompletedAfter, offset)
+	}
+	sort.Slice(c.CompletedAfter, func(i, j int) bool { return c.CompletedAfter[i] < c.CompletedAfter[j] })
+	return c
+}
+
+// due reports whether checkpointInterval passed since the last checkpoint
+func (t *checkpointTracker) due() bool {
+	return time.Since(t.lastSaved) >= checkpointInterval
+}
+
+// save persists a checkpoint
+func (t *checkpointTracker) save(results int, sinkBytes map[string]int64) error {
+	t.lastSaved = time.Now()
+	data, err := json.MarshalIndent(t.checkpoint(results, sinkBytes), "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding checkpoint: %v", err)
+	}
+	// write to a temporary file first so a crash never leaves a truncated checkpoint
+	tmp := filepath.Join(filepath.Dir(t.path), "."+filepath.Base(t.path)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, t.path); err != nil {
+		return fmt.Errorf("writing checkpoint: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayCheckpointDone(t *testing.T) {
+	c := &replayCheckpoint{SettingsSet: 1, Offset: 10, CompletedAfter: []int64{12, 15}}
+
+	tests := []struct {
+		settingsSet int
+		offset      int64
+		want        bool
+	}{
+		{0, 100, true},
+		{1, 9, true},
+		{1, 10, false},
+		{1, 12, true},
+		{1, 13, false},
+		{1, 15, true},
+		{2, 0, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, c.done(tt.settingsSet, tt.offset), "set %d offset %d", tt.settingsSet, tt.offset)
+	}
+
+	var none *replayCheckpoint
+	assert.False(t, none.done(0, 0))
+}
+
+func TestCheckpointTracker(t *testing.T) {
+	tracker := newCheckpointTracker(filepath.Join(t.TempDir(), "checkpoint.json"), nil)
+	tracker.startSettingsSet(0)
+	tracker.dispatched(0)
+	tracker.skipped(1)
+	tracker.dispatched(2)
+	tracker.dispatched(3)
+	tracker.finished(3)
+
+	// query 0 is still running so nothing past it is known to be done
+	c := tracker.checkpoint(1, nil)
+	assert.Equal(t, int64(0), c.Offset)
+	assert.Equal(t, []int64{1, 3}, c.CompletedAfter)
+
+	tracker.finished(0)
+	c = tracker.checkpoint(2, nil)
+	assert.Equal(t, int64(2), c.Offset)
+	assert.Equal(t, []int64{3}, c.CompletedAfter)
+
+	tracker.finished(2)
+	c = tracker.checkpoint(3, nil)
+	assert.Equal(t, int64(4), c.Offset)
+	assert.Empty(t, c.CompletedAfter)
+
+	tracker.startSettingsSet(1)
+	c = tracker.checkpoint(3, map[string]int64{"output.csv": 300})
+	assert.Equal(t, replayCheckpoint{SettingsSet: 1, CompletedAfter: []int64{}, Results: 3, SinkBytes: map[string]int64{"output.csv": 300}}, c)
+}
+
+func TestCheckpointSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	tracker := newCheckpointTracker(path, nil)
+	tracker.dispatched(0)
+	tracker.dispatched(1)
+	tracker.finished(1)
+	require.NoError(t, tracker.save(1, map[string]int64{"output.csv": 42}))
+
+	c, err := loadCheckpoint(path)
+	require.NoError(t, err)
+	assert.Equal(t, &replayCheckpoint{Offset: 0, CompletedAfter: []int64{1}, Results: 1, SinkBytes: map[string]int64{"output.csv": 42}}, c)
+
+	// a resumed tracker picks up where the checkpoint left off
+	resumed := newCheckpointTracker(path, c)
+	resumed.dispatched(0)
+	resumed.finished(0)
+	resumed.skipped(2)
+	assert.Equal(t, int64(3), resumed.checkpoint(2, nil).Offset)
+}
+
+func TestResultRecordRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.csv")
+	sink, err := openCSVSink(path, nil, 0)
+	require.NoError(t, err)
+
+	results := []QueryResult{
+		{
+			queryKind:           "Select",
+			query:               "SELECT 1",
+			normalizedQueryHash: 7,
+			settingsSet:         "default",
+			originalDurationMs:  10,
+			replayDurationMs:    12,
+			deltaMs:             2,
+		},
+		{
+			queryKind:           "Select",
+			query:               "SELECT a, b FROM t",
+			normalizedQueryHash: 8,
+			settingsSet:         "default",
+			queryErrored:        true,
+			errorStr:            "timeout",
+			rewrites:            []string{"literal(a => b)"},
+		},
+	}
+	summary := newSummaryCollector()
+	tracker := newCheckpointTracker(filepath.Join(t.TempDir(), "checkpoint.json"), nil)
+	done := make(chan struct{})
+	ch := make(chan QueryResult)
+	var wg sync.WaitGroup
+	wg.Add(len(results))
+	go resultWriter([]ResultSink{sink}, ch, summary, tracker, 0, &wg, func(error) {}, done)
+	for i, r := range results {
+		tracker.dispatched(int64(i))
+		r.offset = int64(i)
+		ch <- r
+	}
+	close(ch)
+	<-done
+
+	read, err := readResults(path)
+	require.NoError(t, err)
+	require.Len(t, read, 2)
+	for i := range results {
+		assert.Equal(t, results[i].query, read[i].query)
+		assert.Equal(t, results[i].normalizedQueryHash, read[i].normalizedQueryHash)
+		assert.Equal(t, results[i].replayDurationMs, read[i].replayDurationMs)
+		assert.Equal(t, results[i].queryErrored, read[i].queryErrored)
+		assert.Equal(t, results[i].errorStr, read[i].errorStr)
+	}
+	assert.Equal(t, results[1].rewrites, read[1].rewrites)
+
+	// resuming drops rows written after the checkpoint
+	headerBytes := int64(len(strings.Join(resultsHeader(0), ",")) + 1)
+	resumed, err := openCSVSink(path, &replayCheckpoint{SinkBytes: map[string]int64{"output.csv": headerBytes}}, 0)
+	require.NoError(t, err)
+	offset, err := resumed.size()
+	require.NoError(t, err)
+	assert.Equal(t, headerBytes, offset)
+	resumed.Close()
+
+	read, err = readResults(path)
+	require.NoError(t, err)
+	assert.Empty(t, read)
+}
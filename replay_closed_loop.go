@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// LoadStage is a step of a closed-loop replay: Users virtual users issue
+// queries back to back for Duration
+type LoadStage struct {
+	Duration time.Duration `json:"duration"`
+	Users    int           `json:"users"`
+}
+
+// parseLoadStages parses stages given as duration:users, e.g. 1m:10
+func parseLoadStages(specs []string) ([]LoadStage, error) {
+	stages := make([]LoadStage, 0, len(specs))
+	for _, spec := range specs {
+		duration, users, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid stage '%s', expected duration:users", spec)
+		}
+		var (
+			stage LoadStage
+			err   error
+		)
+		if stage.Duration, err = time.ParseDuration(strings.TrimSpace(duration)); err != nil || stage.Duration <= 0 {
+			return nil, fmt.Errorf("invalid stage '%s', the duration must be positive, e.g. 30s or 2m", spec)
+		}
+		if stage.Users, err = strconv.Atoi(strings.TrimSpace(users)); err != nil || stage.Users <= 0 {
+			return nil, fmt.Errorf("invalid stage '%s', the number of users must be positive", spec)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// loadWorkload reads the replayable queries of the workload file into memory
+func loadWorkload(opts *ReplayOptions) ([]Query, error) {
+	file, err := os.Open(opts.WorkloadFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening workload file: %v", err)
+	}
+	defer file.Close()
+
+	var workload []Query
+	r := csv.NewReader(file)
+	for offset := int64(0); ; offset++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		q, ok := prepareQuery(opts, record)
+		if !ok {
+			continue
+		}
+		q.offset = offset
+		workload = append(workload, q)
+	}
+	if len(workload) == 0 {
+		return nil, fmt.Errorf("workload file %s has no queries to replay", opts.WorkloadFile)
+	}
+	return workload, nil
+}
+
+// closedLoopQueryID is the query_id of the n-th query of a virtual user,
+// queries of the workload are replayed many times in a closed loop
+func closedLoopQueryID(runID string, settingsSet, stage, user, n int) string {
+	return fmt.Sprintf("%s-%d-s%d-u%d-%d", runID, settingsSet, stage+1, user, n)
+}
+
+// runClosedLoop replays the workload through the load stages. Every virtual
+// user issues its next query as soon as the previous one finished, so the
+// load adapts to the target's throughput instead of following the original
+// timeline. A stage ends once its duration passed and the queries of its
+// users completed.
+func runClosedLoop(ctx context.Context, opts *ReplayOptions, settingsSet int, workload []Query, queries chan<- Query, wg *sync.WaitGroup) error {
+	set := opts.SettingsSets[settingsSet]
+	settings := replaySettings(opts, set)
+	for i, stage := range opts.LoadStages {
+		log.Infof("Closed-loop stage %d: %d virtual users for %s", i+1, stage.Users, stage.Duration)
+		stageCtx, cancel := context.WithTimeout(ctx, stage.Duration)
+		var users sync.WaitGroup
+		for user := 0; user < stage.Users; user++ {
+			users.Add(1)
+			go func(user int) {
+				defer users.Done()
+				u := virtualUser{
+					opts:        opts,
+					settingsSet: settingsSet,
+					stage:       i,
+					user:        user,
+					// seeded per stage and user so a run always picks the same queries
+					rng: rand.New(rand.NewSource(int64(opts.Sampling.Seed) + int64(i)<<32 + int64(user))),
+				}
+				u.run(stageCtx, workload, set.Name, settings, queries, wg)
+			}(user)
+		}
+		users.Wait()
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type virtualUser struct {
+	opts        *ReplayOptions
+	settingsSet int
+	stage       int
+	user        int
+	rng         *rand.Rand
+}
+
+func (u *virtualUser) run(ctx context.Context, workload []Query, setName string, settings clickhouse.Settings, queries chan<- Query, wg *sync.WaitGroup) {
+	done := make(chan struct{}, 1)
+	for n := 0; ctx.Err() == nil; n++ {
+		q := workload[u.rng.Intn(len(workload))]
+		q.settingsSet = setName
+		q.settings = settings
+		q.stage = u.stage + 1
+		q.queryID = closedLoopQueryID(u.opts.RunID, u.settingsSet, u.stage, u.user, n)
+		q.done = done
+		wg.Add(1)
+		select {
+		case queries <- q:
+			u.opts.Progress.dispatch(q, time.Time{})
+		case <-ctx.Done():
+			wg.Done()
+			return
+		}
+		// the query is waited for even when the stage ended so it is
+		// accounted to the stage that issued it
+		<-done
+	}
+}
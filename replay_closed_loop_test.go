@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLoadStages(t *testing.T) {
+	stages, err := parseLoadStages([]string{"30s:10", "2m:50"})
+	require.NoError(t, err)
+	assert.Equal(t, []LoadStage{{Duration: 30 * time.Second, Users: 10}, {Duration: 2 * time.Minute, Users: 50}}, stages)
+
+	for _, spec := range []string{"30s", "30:10", "0s:10", "30s:0", "30s:many"} {
+		_, err := parseLoadStages([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestRunClosedLoop(t *testing.T) {
+	opts := &ReplayOptions{
+		RunID:        "run",
+		SettingsSets: []SettingsSet{{Name: "default"}},
+		LoadStages: []LoadStage{
+			{Duration: 20 * time.Millisecond, Users: 1},
+			{Duration: 20 * time.Millisecond, Users: 3},
+		},
+	}
+	workload := []Query{{query: "SELECT 1"}, {query: "SELECT 2"}}
+	queries := make(chan Query)
+	var wg sync.WaitGroup
+
+	// a stand-in for the workers that completes every query after a millisecond
+	var (
+		mu       sync.Mutex
+		received []Query
+	)
+	go func() {
+		for q := range queries {
+			mu.Lock()
+			received = append(received, q)
+			mu.Unlock()
+			go func(q Query) {
+				time.Sleep(time.Millisecond)
+				wg.Done()
+				q.done <- struct{}{}
+			}(q)
+		}
+	}()
+
+	require.NoError(t, runClosedLoop(context.Background(), opts, 0, workload, queries, &wg))
+	wg.Wait()
+	close(queries)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, received)
+	ids := map[string]bool{}
+	users := map[int]map[string]bool{}
+	for _, q := range received {
+		assert.False(t, ids[q.queryID], "query_id %s is reused", q.queryID)
+		ids[q.queryID] = true
+		assert.Equal(t, "run", q.settings["log_comment"])
+		if users[q.stage] == nil {
+			users[q.stage] = map[string]bool{}
+		}
+		users[q.stage][q.queryID[:len("run-0-s1-u0")]] = true
+	}
+	assert.Len(t, users[1], 1)
+	assert.Len(t, users[2], 3)
+}
+
+func TestRunClosedLoopStopsWhenCancelled(t *testing.T) {
+	opts := &ReplayOptions{
+		SettingsSets: []SettingsSet{{Name: "default"}},
+		LoadStages:   []LoadStage{{Duration: time.Hour, Users: 2}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var wg sync.WaitGroup
+	err := runClosedLoop(ctx, opts, 0, []Query{{query: "SELECT 1"}}, make(chan Query), &wg)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// comparedReplay is the replay of a query on one of the additional targets
+// of an A/B replay. The first target's replay is recorded in the
+// QueryResult itself.
+type comparedReplay struct {
+	replayDurationMs uint64
+	queryErrored     bool
+	errorStr         string
+	rowCount         uint64
+	resultHash       uint64
+}
+
+// compareTargetName labels the additional target i in output.csv and the
+// summary, the first target being target1
+func compareTargetName(i int) string {
+	return fmt.Sprintf("target%d", i+2)
+}
+
+// targetRun is the outcome of running a query on a single target
+type targetRun struct {
+	start      time.Time
+	end        time.Time
+	rowCount   uint64
+	resultHash uint64
+	err        error
+}
+
+func (r targetRun) durationMs() uint64 {
+	return uint64(r.end.Sub(r.start).Milliseconds())
+}
+
+// runOnTarget runs a query on conn, reading its result when verify is set
+// so that the checksum can be compared
+func runOnTarget(ctx context.Context, conn *sql.DB, query string, verify bool) targetRun {
+	r := targetRun{start: time.Now()}
+	if verify {
+		r.rowCount, r.resultHash, r.err = resultChecksum(ctx, conn, query)
+	} else {
+		_, r.err = conn.ExecContext(ctx, query)
+	}
+	r.end = time.Now()
+	return r
+}
+
+// runOnTargets runs a query on the target and all compare targets at the
+// same time
+func runOnTargets(ctx context.Context, conn *sql.DB, compareConns []*sql.DB, query string, verify bool) (targetRun, []targetRun) {
+	compared := make([]targetRun, len(compareConns))
+	var wg sync.WaitGroup
+	for i, compareConn := range compareConns {
+		wg.Add(1)
+		go func(i int, compareConn *sql.DB) {
+			defer wg.Done()
+			compared[i] = runOnTarget(ctx, compareConn, query, verify)
+		}(i, compareConn)
+	}
+	primary := runOnTarget(ctx, conn, query, verify)
+	wg.Wait()
+	return primary, compared
+}
+
+// compareColumns lists the output.csv columns of the additional targets
+func compareColumns(compareTargets int) []string {
+	var columns []string
+	for i := 0; i < compareTargets; i++ {
+		name := compareTargetName(i)
+		columns = append(columns,
+			name+"_replay_duration_ms",
+			name+"_query_errored",
+			name+"_error",
+			name+"_result_rows",
+			name+"_result_hash",
+			name+"_duration_ratio",
+		)
+	}
+	return columns
+}
+
+// compareRecord encodes the replays on the additional targets. The ratio
+// is relative to the first target and left empty if either errored.
+func compareRecord(r QueryResult) []string {
+	var record []string
+	for _, c := range r.compared {
+		ratio := ""
+		if !c.queryErrored && !r.queryErrored {
+			ratio = strconv.FormatFloat(slowdown(r.replayDurationMs, c.replayDurationMs), 'f', 4, 64)
+		}
+		record = append(record,
+			strconv.FormatUint(c.replayDurationMs, 10),
+			strconv.FormatBool(c.queryErrored),
+			c.errorStr,
+			strconv.FormatUint(c.rowCount, 10),
+			strconv.FormatUint(c.resultHash, 10),
+			ratio,
+		)
+	}
+	return record
+}
+
+// parseCompared decodes the replays on the additional targets from a row
+// of output.csv
+func parseCompared(columns map[string]int, record []string) ([]comparedReplay, error) {
+	var compared []comparedReplay
+	for i := 0; ; i++ {
+		name := compareTargetName(i)
+		if _, ok := columns[name+"_replay_duration_ms"]; !ok {
+			return compared, nil
+		}
+		field := func(suffix string) string {
+			if j, ok := columns[name+suffix]; ok && j < len(record) {
+				return record[j]
+			}
+			return ""
+		}
+		var (
+			c   comparedReplay
+			err error
+		)
+		if c.replayDurationMs, err = strconv.ParseUint(field("_replay_duration_ms"), 10, 64); err != nil {
+			return nil, fmt.Errorf("parsing %s duration: %v", name, err)
+		}
+		if c.queryErrored, err = strconv.ParseBool(field("_query_errored")); err != nil {
+			return nil, fmt.Errorf("parsing %s errored: %v", name, err)
+		}
+		c.errorStr = field("_error")
+		if c.rowCount, err = strconv.ParseUint(field("_result_rows"), 10, 64); err != nil {
+			return nil, fmt.Errorf("parsing %s result rows: %v", name, err)
+		}
+		if c.resultHash, err = strconv.ParseUint(field("_result_hash"), 10, 64); err != nil {
+			return nil, fmt.Errorf("parsing %s result hash: %v", name, err)
+		}
+		compared = append(compared, c)
+	}
+}
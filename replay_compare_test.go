@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareResultRecord(t *testing.T) {
+	header := resultsHeader(2)
+	assert.Equal(t, "query", header[len(header)-1])
+	assert.Contains(t, header, "target2_duration_ratio")
+	assert.Contains(t, header, "target3_replay_duration_ms")
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	r := QueryResult{
+		query:            "SELECT 1",
+		replayDurationMs: 10,
+		compared: []comparedReplay{
+			{replayDurationMs: 25, rowCount: 1, resultHash: 42},
+			{queryErrored: true, errorStr: "code: 60, table doesn't exist"},
+		},
+	}
+	record := resultRecord(1, r)
+	require.Len(t, record, len(header))
+	assert.Equal(t, "2.5000", record[columns["target2_duration_ratio"]])
+	assert.Equal(t, "", record[columns["target3_duration_ratio"]])
+
+	parsed, err := parseResultRecord(columns, record)
+	require.NoError(t, err)
+	assert.Equal(t, r.compared, parsed.compared)
+
+	// results of single target runs have no compare columns
+	header = resultsHeader(0)
+	columns = make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	parsed, err = parseResultRecord(columns, resultRecord(1, QueryResult{query: "SELECT 1"}))
+	require.NoError(t, err)
+	assert.Empty(t, parsed.compared)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+const (
+	// diffBootstrapIterations is the number of resamples used to estimate
+	// the confidence interval of a latency change
+	diffBootstrapIterations = 1000
+	// diffConfidence is the confidence level of the reported intervals
+	diffConfidence = 0.95
+)
+
+// ShapeDiff compares the latencies of a query shape between two runs.
+// Change is the ratio of run B's p50 to run A's, CILow and CIHigh bound it
+// at the diffConfidence level.
+type ShapeDiff struct {
+	SettingsSet         string  `json:"settings_set"`
+	NormalizedQueryHash uint64  `json:"normalized_query_hash"`
+	ExampleQuery        string  `json:"example_query"`
+	CountA              int     `json:"count_a"`
+	CountB              int     `json:"count_b"`
+	ErrorsA             int     `json:"errors_a"`
+	ErrorsB             int     `json:"errors_b"`
+	P50A                uint64  `json:"p50_a_ms"`
+	P50B                uint64  `json:"p50_b_ms"`
+	P95A                uint64  `json:"p95_a_ms"`
+	P95B                uint64  `json:"p95_b_ms"`
+	Change              float64 `json:"change"`
+	CILow               float64 `json:"ci_low"`
+	CIHigh              float64 `json:"ci_high"`
+	// Significant is set when the confidence interval excludes no change
+	Significant bool `json:"significant"`
+}
+
+// ErrorDiff is a query that errored in only one of the runs
+type ErrorDiff struct {
+	SettingsSet         string `json:"settings_set"`
+	NormalizedQueryHash uint64 `json:"normalized_query_hash"`
+	Query               string `json:"query"`
+	Error               string `json:"error"`
+}
+
+type ReplayDiff struct {
+	RunA string `json:"run_a"`
+	RunB string `json:"run_b"`
+	// Shapes are ranked from the worst regression to the best improvement
+	Shapes []ShapeDiff `json:"shapes"`
+	// NewErrors errored in run B but not in run A, FixedErrors the other way round
+	NewErrors   []ErrorDiff `json:"new_errors"`
+	FixedErrors []ErrorDiff `json:"fixed_errors"`
+	// OnlyInA and OnlyInB count the query shapes replayed by just one run
+	OnlyInA int `json:"only_in_a"`
+	OnlyInB int `json:"only_in_b"`
+}
+
+// resultsPath accepts either a run directory or the path of an output.csv
+func resultsPath(run string) string {
+	if info, err := os.Stat(run); err == nil && info.IsDir() {
+		return filepath.Join(run, "output.csv")
+	}
+	return run
+}
+
+type diffSamples struct {
+	exampleQuery string
+	errors       int
+	durations    []uint64
+}
+
+type queryKey struct {
+	settingsSet string
+	query       string
+}
+
+// queryOutcome records whether a query errored in every replay of a run
+type queryOutcome struct {
+	normalizedQueryHash uint64
+	errored             bool
+	errorStr            string
+}
+
+func groupResults(results []QueryResult) (map[shapeKey]*diffSamples, map[queryKey]queryOutcome) {
+	shapes := make(map[shapeKey]*diffSamples)
+	queries := make(map[queryKey]queryOutcome)
+	for _, r := range results {
+		key := shapeKey{settingsSet: r.settingsSet, normalizedQueryHash: r.normalizedQueryHash}
+		shape, ok := shapes[key]
+		if !ok {
+			shape = &diffSamples{exampleQuery: r.query}
+			shapes[key] = shape
+		}
+		if r.queryErrored {
+			shape.errors++
+		} else {
+			shape.durations = append(shape.durations, r.replayDurationMs)
+		}
+
+		qKey := queryKey{settingsSet: r.settingsSet, query: r.query}
+		outcome, seen := queries[qKey]
+		if !seen {
+			outcome = queryOutcome{normalizedQueryHash: r.normalizedQueryHash, errored: true}
+		}
+		// a query counts as errored only if all of its replays errored
+		if r.queryErrored {
+			if outcome.errorStr == "" {
+				outcome.errorStr = r.errorStr
+			}
+		} else {
+			outcome.errored = false
+		}
+		queries[qKey] = outcome
+	}
+	return shapes, queries
+}
+
+// singleSettingsSet returns the settings set of results replayed with only
+// one
+func singleSettingsSet(results []QueryResult) (string, bool) {
+	if len(results) == 0 {
+		return "", false
+	}
+	for _, r := range results[1:] {
+		if r.settingsSet != results[0].settingsSet {
+			return "", false
+		}
+	}
+	return results[0].settingsSet, true
+}
+
+// pairSettingsSets relabels two runs that each replayed a single, different
+// settings set, e.g. a baseline against a run with --setting, as "a vs b" so
+// that their shapes and queries are joined whatever the settings set
+func pairSettingsSets(a, b []QueryResult) ([]QueryResult, []QueryResult) {
+	setA, okA := singleSettingsSet(a)
+	setB, okB := singleSettingsSet(b)
+	if !okA || !okB || setA == setB {
+		return a, b
+	}
+	label := setA + " vs " + setB
+	relabel := func(results []QueryResult) []QueryResult {
+		relabeled := make([]QueryResult, len(results))
+		for i, r := range results {
+			r.settingsSet = label
+			relabeled[i] = r
+		}
+		return relabeled
+	}
+	return relabel(a), relabel(b)
+}
+
+// diffResults compares the results of two runs of the same workload. Shapes
+// are joined by settings set and normalized query hash, errors by query text.
+// Runs that each replayed a single settings set are joined on the query
+// alone.
+func diffResults(a, b []QueryResult) ReplayDiff {
+	a, b = pairSettingsSets(a, b)
+	shapesA, queriesA := groupResults(a)
+	shapesB, queriesB := groupResults(b)
+
+	d := ReplayDiff{
+		Shapes:      []ShapeDiff{},
+		NewErrors:   []ErrorDiff{},
+		FixedErrors: []ErrorDiff{},
+	}
+	for key, shapeA := range shapesA {
+		shapeB, ok := shapesB[key]
+		if !ok {
+			d.OnlyInA++
+			continue
+		}
+		statsA := durationStats(shapeA.durations)
+		statsB := durationStats(shapeB.durations)
+		shape := ShapeDiff{
+			SettingsSet:         key.settingsSet,
+			NormalizedQueryHash: key.normalizedQueryHash,
+			ExampleQuery:        shapeA.exampleQuery,
+			CountA:              len(shapeA.durations) + shapeA.errors,
+			CountB:              len(shapeB.durations) + shapeB.errors,
+			ErrorsA:             shapeA.errors,
+			ErrorsB:             shapeB.errors,
+			P50A:                statsA.P50,
+			P50B:                statsB.P50,
+			P95A:                statsA.P95,
+			P95B:                statsB.P95,
+		}
+		if len(shapeA.durations) > 0 && len(shapeB.durations) > 0 {
+			shape.Change = slowdown(statsA.P50, statsB.P50)
+			// seeding by shape keeps the confidence intervals of a diff reproducible
+			rng := rand.New(rand.NewSource(int64(key.normalizedQueryHash)))
+			shape.CILow, shape.CIHigh = medianRatioCI(shapeA.durations, shapeB.durations, rng)
+			shape.Significant = shape.CILow > 1 || shape.CIHigh < 1
+		}
+		d.Shapes = append(d.Shapes, shape)
+	}
+	for key := range shapesB {
+		if _, ok := shapesA[key]; !ok {
+			d.OnlyInB++
+		}
+	}
+	sort.Slice(d.Shapes, func(i, j int) bool {
+		if d.Shapes[i].Change != d.Shapes[j].Change {
+			return d.Shapes[i].Change > d.Shapes[j].Change
+		}
+		if d.Shapes[i].SettingsSet != d.Shapes[j].SettingsSet {
+			return d.Shapes[i].SettingsSet < d.Shapes[j].SettingsSet
+		}
+		return d.Shapes[i].NormalizedQueryHash < d.Shapes[j].NormalizedQueryHash
+	})
+
+	for key, outcomeB := range queriesB {
+		outcomeA, ok := queriesA[key]
+		if !ok || outcomeA.errored == outcomeB.errored {
+			continue
+		}
+		if outcomeB.errored {
+			d.NewErrors = append(d.NewErrors, ErrorDiff{key.settingsSet, outcomeB.normalizedQueryHash, key.query, outcomeB.errorStr})
+		} else {
+			d.FixedErrors = append(d.FixedErrors, ErrorDiff{key.settingsSet, outcomeA.normalizedQueryHash, key.query, outcomeA.errorStr})
+		}
+	}
+	sortErrorDiffs(d.NewErrors)
+	sortErrorDiffs(d.FixedErrors)
+	return d
+}
+
+func sortErrorDiffs(errs []ErrorDiff) {
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].SettingsSet != errs[j].SettingsSet {
+			return errs[i].SettingsSet < errs[j].SettingsSet
+		}
+		return errs[i].Query < errs[j].Query
+	})
+}
+
+// medianRatioCI estimates a confidence interval for the ratio of the median
+// of b to the median of a by bootstrapping both samples
+func medianRatioCI(a, b []uint64, rng *rand.Rand) (float64, float64) {
+	ratios := make([]float64, diffBootstrapIterations)
+	resampleA := make([]uint64, len(a))
+	resampleB := make([]uint64, len(b))
+	for i := range ratios {
+		for j := range resampleA {
+			resampleA[j] = a[rng.Intn(len(a))]
+		}
+		for j := range resampleB {
+			resampleB[j] = b[rng.Intn(len(b))]
+		}
+		ratios[i] = slowdown(durationStats(resampleA).P50, durationStats(resampleB).P50)
+	}
+	sort.Float64s(ratios)
+	tail := (1 - diffConfidence) / 2 * 100
+	return percentile(ratios, tail), percentile(ratios, 100-tail)
+}
+
+func printDiff(w io.Writer, d ReplayDiff, limit int) {
+	fmt.Fprintf(w, "\nComparing %s (A) with %s (B): %d query shapes in both runs, %d only in A, %d only in B\n",
+		d.RunA, d.RunB, len(d.Shapes), d.OnlyInA, d.OnlyInB)
+
+	shapes := d.Shapes
+	if limit > 0 && len(shapes) > limit {
+		shapes = shapes[:limit]
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "settings set\tnormalized_query_hash\tcount a\tcount b\tp50 a ms\tp50 b ms\tchange\t95% ci\terrors a\terrors b\tquery")
+	for _, s := range shapes {
+		marker := ""
+		if s.Significant {
+			marker = " *"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%.2fx%s\t%.2f-%.2f\t%d\t%d\t%s\n",
+			s.SettingsSet, s.NormalizedQueryHash, s.CountA, s.CountB, s.P50A, s.P50B, s.Change, marker,
+			s.CILow, s.CIHigh, s.ErrorsA, s.ErrorsB, truncateQuery(s.ExampleQuery, 80))
+	}
+	tw.Flush()
+	if len(shapes) < len(d.Shapes) {
+		fmt.Fprintf(w, "... %d more query shapes\n", len(d.Shapes)-len(shapes))
+	}
+
+	printErrorDiffs(w, "New errors in B", d.NewErrors, limit)
+	printErrorDiffs(w, "Errors fixed in B", d.FixedErrors, limit)
+}
+
+func printErrorDiffs(w io.Writer, title string, errs []ErrorDiff, limit int) {
+	fmt.Fprintf(w, "\n%s: %d\n", title, len(errs))
+	if limit > 0 && len(errs) > limit {
+		errs = errs[:limit]
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, e := range errs {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", e.SettingsSet, e.NormalizedQueryHash, truncateQuery(e.Error, 60), truncateQuery(e.Query, 80))
+	}
+	tw.Flush()
+}
+
+func writeDiff(path string, d ReplayDiff) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding diff: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing diff: %v", err)
+	}
+	return nil
+}
+
+// diffRuns compares the results of two replay runs
+func diffRuns(runA, runB string) (ReplayDiff, error) {
+	a, err := readResults(resultsPath(runA))
+	if err != nil {
+		return ReplayDiff{}, err
+	}
+	b, err := readResults(resultsPath(runB))
+	if err != nil {
+		return ReplayDiff{}, err
+	}
+	d := diffResults(a, b)
+	d.RunA, d.RunB = runA, runB
+	return d, nil
+}
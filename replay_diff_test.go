@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffResults(t *testing.T) {
+	var a, b []QueryResult
+	for i := uint64(0); i < 50; i++ {
+		// shape 1 got twice as slow, shape 2 stayed the same
+		a = append(a, QueryResult{normalizedQueryHash: 1, query: "SELECT 1", replayDurationMs: 100 + i%5})
+		b = append(b, QueryResult{normalizedQueryHash: 1, query: "SELECT 1", replayDurationMs: 200 + i%5})
+		a = append(a, QueryResult{normalizedQueryHash: 2, query: "SELECT 2", replayDurationMs: 50 + i%10})
+		b = append(b, QueryResult{normalizedQueryHash: 2, query: "SELECT 2", replayDurationMs: 50 + (i+3)%10})
+	}
+	a = append(a,
+		QueryResult{normalizedQueryHash: 3, query: "SELECT 3", queryErrored: true, errorStr: "timeout"},
+		QueryResult{normalizedQueryHash: 4, query: "SELECT 4", replayDurationMs: 10},
+		QueryResult{normalizedQueryHash: 5, query: "SELECT 5", replayDurationMs: 10},
+	)
+	b = append(b,
+		QueryResult{normalizedQueryHash: 3, query: "SELECT 3", replayDurationMs: 10},
+		QueryResult{normalizedQueryHash: 4, query: "SELECT 4", queryErrored: true, errorStr: "unknown function"},
+		QueryResult{normalizedQueryHash: 6, query: "SELECT 6", replayDurationMs: 10},
+	)
+
+	d := diffResults(a, b)
+	assert.Equal(t, 1, d.OnlyInA)
+	assert.Equal(t, 1, d.OnlyInB)
+	require.Len(t, d.Shapes, 4)
+
+	worst := d.Shapes[0]
+	assert.Equal(t, uint64(1), worst.NormalizedQueryHash)
+	assert.Equal(t, uint64(102), worst.P50A)
+	assert.Equal(t, uint64(202), worst.P50B)
+	assert.InDelta(t, 202.0/102, worst.Change, 1e-9)
+	assert.True(t, worst.Significant)
+	assert.LessOrEqual(t, worst.CILow, worst.Change)
+	assert.GreaterOrEqual(t, worst.CIHigh, worst.Change)
+
+	for _, s := range d.Shapes {
+		if s.NormalizedQueryHash == 2 {
+			assert.False(t, s.Significant)
+			assert.Less(t, s.CILow, 1.0+1e-9)
+			assert.Greater(t, s.CIHigh, 1.0-1e-9)
+		}
+	}
+
+	assert.Equal(t, []ErrorDiff{{NormalizedQueryHash: 4, Query: "SELECT 4", Error: "unknown function"}}, d.NewErrors)
+	assert.Equal(t, []ErrorDiff{{NormalizedQueryHash: 3, Query: "SELECT 3", Error: "timeout"}}, d.FixedErrors)
+
+	// the same inputs always produce the same intervals
+	assert.Equal(t, d, diffResults(a, b))
+}
+
+func TestDiffResultsSettingsSets(t *testing.T) {
+	// a baseline against a run with --setting max_threads=4
+	var a, b []QueryResult
+	for i := uint64(0); i < 20; i++ {
+		a = append(a, QueryResult{settingsSet: "default", normalizedQueryHash: 1, query: "SELECT 1", replayDurationMs: 100 + i%5})
+		b = append(b, QueryResult{settingsSet: "max_threads=4", normalizedQueryHash: 1, query: "SELECT 1", replayDurationMs: 50 + i%5})
+	}
+	b = append(b, QueryResult{settingsSet: "max_threads=4", normalizedQueryHash: 2, query: "SELECT 2", queryErrored: true, errorStr: "timeout"})
+	a = append(a, QueryResult{settingsSet: "default", normalizedQueryHash: 2, query: "SELECT 2", replayDurationMs: 10})
+
+	d := diffResults(a, b)
+	assert.Zero(t, d.OnlyInA)
+	assert.Zero(t, d.OnlyInB)
+	require.Len(t, d.Shapes, 2)
+	assert.Equal(t, "default vs max_threads=4", d.Shapes[0].SettingsSet)
+	for _, s := range d.Shapes {
+		if s.NormalizedQueryHash == 1 {
+			assert.InDelta(t, 52.0/102, s.Change, 1e-9)
+		}
+	}
+	assert.Equal(t, []ErrorDiff{{SettingsSet: "default vs max_threads=4", NormalizedQueryHash: 2, Query: "SELECT 2", Error: "timeout"}}, d.NewErrors)
+
+	// runs replaying several settings sets are still joined by settings set
+	b[0].settingsSet = "other"
+	d = diffResults(a, b)
+	assert.Equal(t, 2, d.OnlyInA)
+}
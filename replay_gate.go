@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errReplayGateFailed is returned by replayQueryHistory when the replay
+// breached one of the configured regression thresholds
+var errReplayGateFailed = errors.New("replay breached regression thresholds")
+
+// GateThresholds configures when a replay counts as a regression. A
+// negative threshold disables the corresponding check.
+type GateThresholds struct {
+	// MaxP95Slowdown is the maximum allowed relative increase of a query
+	// shape's p95 duration, 0.2 allows the replay to be 20% slower
+	MaxP95Slowdown float64 `json:"max_p95_slowdown"`
+	// MaxErrorRate is the maximum allowed fraction of errored queries, both
+	// overall and per query shape
+	MaxErrorRate float64 `json:"max_error_rate"`
+	// MinCount is the number of executions a query shape needs before it is
+	// evaluated, so that shapes seen only a handful of times don't fail a run
+	MinCount int `json:"min_count"`
+}
+
+func (t GateThresholds) enabled() bool {
+	return t.MaxP95Slowdown >= 0 || t.MaxErrorRate >= 0
+}
+
+type GateBreach struct {
+	SettingsSet string `json:"settings_set,omitempty"`
+	// NormalizedQueryHash is 0 for breaches of the overall error rate
+	NormalizedQueryHash uint64  `json:"normalized_query_hash"`
+	ExampleQuery        string  `json:"example_query,omitempty"`
+	Metric              string  `json:"metric"`
+	Value               float64 `json:"value"`
+	Threshold           float64 `json:"threshold"`
+}
+
+type GateVerdict struct {
+	Passed     bool           `json:"passed"`
+	Thresholds GateThresholds `json:"thresholds"`
+	Breaches   []GateBreach   `json:"breaches"`
+}
+
+func evaluateGate(s ReplaySummary, t GateThresholds) GateVerdict {
+	verdict := GateVerdict{
+		Thresholds: t,
+		Breaches:   []GateBreach{},
+	}
+
+	if t.MaxErrorRate >= 0 && s.ErrorRate > t.MaxErrorRate {
+		verdict.Breaches = append(verdict.Breaches, GateBreach{
+			Metric:    "error_rate",
+			Value:     s.ErrorRate,
+			Threshold: t.MaxErrorRate,
+		})
+	}
+
+	for _, shape := range s.Shapes {
+		if shape.Count < t.MinCount {
+			continue
+		}
+		if t.MaxErrorRate >= 0 && shape.ErrorRate > t.MaxErrorRate {
+			verdict.Breaches = append(verdict.Breaches, GateBreach{
+				SettingsSet:         shape.SettingsSet,
+				NormalizedQueryHash: shape.NormalizedQueryHash,
+				ExampleQuery:        shape.ExampleQuery,
+				Metric:              "error_rate",
+				Value:               shape.ErrorRate,
+				Threshold:           t.MaxErrorRate,
+			})
+		}
+		// shapes that only errored have no durations to compare
+		if shape.Errors == shape.Count {
+			continue
+		}
+		p95Slowdown := slowdown(shape.Original.P95, shape.Replay.P95) - 1
+		if t.MaxP95Slowdown >= 0 && p95Slowdown > t.MaxP95Slowdown {
+			verdict.Breaches = append(verdict.Breaches, GateBreach{
+				SettingsSet:         shape.SettingsSet,
+				NormalizedQueryHash: shape.NormalizedQueryHash,
+				ExampleQuery:        shape.ExampleQuery,
+				Metric:              "p95_slowdown",
+				Value:               p95Slowdown,
+				Threshold:           t.MaxP95Slowdown,
+			})
+		}
+	}
+
+	verdict.Passed = len(verdict.Breaches) == 0
+	return verdict
+}
+
+func writeVerdict(path string, v GateVerdict) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding verdict: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing verdict: %v", err)
+	}
+	return nil
+}
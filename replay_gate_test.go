@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvaluateGate(t *testing.T) {
+	summary := ReplaySummary{
+		Count:     200,
+		Errors:    3,
+		ErrorRate: 0.015,
+		Shapes: []QueryShapeSummary{
+			{
+				NormalizedQueryHash: 1,
+				Count:               100,
+				Original:            DurationStats{P95: 100},
+				Replay:              DurationStats{P95: 150},
+			},
+			{
+				NormalizedQueryHash: 2,
+				Count:               95,
+				Errors:              3,
+				ErrorRate:           3.0 / 95,
+				Original:            DurationStats{P95: 100},
+				Replay:              DurationStats{P95: 110},
+			},
+			{
+				// too few executions to be evaluated
+				NormalizedQueryHash: 3,
+				Count:               5,
+				Original:            DurationStats{P95: 10},
+				Replay:              DurationStats{P95: 100},
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		thresholds GateThresholds
+		want       []GateBreach
+	}{
+		{
+			name:       "slowdown only",
+			thresholds: GateThresholds{MaxP95Slowdown: 0.2, MaxErrorRate: -1, MinCount: 10},
+			want: []GateBreach{
+				{NormalizedQueryHash: 1, Metric: "p95_slowdown", Value: 0.5, Threshold: 0.2},
+			},
+		},
+		{
+			name:       "error rate only",
+			thresholds: GateThresholds{MaxP95Slowdown: -1, MaxErrorRate: 0.02, MinCount: 10},
+			want: []GateBreach{
+				{NormalizedQueryHash: 2, Metric: "error_rate", Value: 3.0 / 95, Threshold: 0.02},
+			},
+		},
+		{
+			name:       "overall error rate",
+			thresholds: GateThresholds{MaxP95Slowdown: -1, MaxErrorRate: 0.01, MinCount: 10},
+			want: []GateBreach{
+				{Metric: "error_rate", Value: 0.015, Threshold: 0.01},
+				{NormalizedQueryHash: 2, Metric: "error_rate", Value: 3.0 / 95, Threshold: 0.01},
+			},
+		},
+		{
+			name:       "within thresholds",
+			thresholds: GateThresholds{MaxP95Slowdown: 0.6, MaxErrorRate: 0.05, MinCount: 10},
+			want:       []GateBreach{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := evaluateGate(summary, tt.thresholds)
+			assert.Equal(t, len(tt.want) == 0, got.Passed)
+			assert.Len(t, got.Breaches, len(tt.want))
+			for i, want := range tt.want {
+				assert.Equal(t, want.NormalizedQueryHash, got.Breaches[i].NormalizedQueryHash)
+				assert.Equal(t, want.Metric, got.Breaches[i].Metric)
+				assert.InDelta(t, want.Value, got.Breaches[i].Value, 1e-9)
+				assert.Equal(t, want.Threshold, got.Breaches[i].Threshold)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// replayableKinds are the query_kind values that can be replayed. Inserts
+// are limited to INSERT ... SELECT since the data of other inserts is not
+// part of the query log.
+var replayableKinds = []string{"Select", "Insert"}
+
+var (
+	insertSelectRe   = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+.*?\bSELECT\b`)
+	insertFunctionRe = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+FUNCTION\b`)
+	insertTargetRe   = regexp.MustCompile("(?is)^(\\s*INSERT\\s+INTO\\s+(?:TABLE\\s+)?)(?:(?:`[^`]+`|\\w+)\\.)?(`[^`]+`|\\w+)")
+	// leadingNoiseRe matches the whitespace, comments and opening
+	// parentheses that may precede the first keyword of a statement
+	leadingNoiseRe = regexp.MustCompile(`^(?:\s+|--[^\n]*(?:\n|$)|#[^\n]*(?:\n|$)|/\*(?s:.*?)\*/|\()*`)
+	keywordRe      = regexp.MustCompile(`^[A-Za-z]+`)
+)
+
+// readOnlyRejection prefixes the error of queries rejected by read-only mode
+const readOnlyRejection = "rejected by read-only mode"
+
+// readOnlyKeywords are the statements read-only mode lets through
+var readOnlyKeywords = []string{"SELECT", "WITH"}
+
+// checkReadOnly rejects every statement but SELECT, so that nothing
+// replayed in read-only mode can modify the target whatever the captured
+// workload contains
+func checkReadOnly(query string) error {
+	rest := query[len(leadingNoiseRe.FindString(query)):]
+	keyword := strings.ToUpper(keywordRe.FindString(rest))
+	if keyword == "" {
+		return fmt.Errorf("%s: can't tell what the statement does", readOnlyRejection)
+	}
+	if !includes(readOnlyKeywords, keyword) {
+		return fmt.Errorf("%s: %s statements are not allowed", readOnlyRejection, keyword)
+	}
+	return nil
+}
+
+func validateKinds(kinds []string) error {
+	if len(kinds) == 0 {
+		return fmt.Errorf("at least one query kind must be replayed")
+	}
+	for _, kind := range kinds {
+		if !includes(replayableKinds, kind) {
+			return fmt.Errorf("query kind '%s' can't be replayed, supported kinds are %s", kind, strings.Join(replayableKinds, ", "))
+		}
+	}
+	return nil
+}
+
+// isReplayableInsert reports whether query is an INSERT ... SELECT into a
+// table. INSERT INTO FUNCTION is excluded since it writes outside the target.
+func isReplayableInsert(query string) bool {
+	return insertSelectRe.MatchString(query) && !insertFunctionRe.MatchString(query)
+}
+
+// redirectInsert rewrites the table an INSERT writes into to a table of the
+// same name in the shadow database
+func redirectInsert(query, shadowDatabase string) (string, error) {
+	loc := insertTargetRe.FindStringSubmatchIndex(query)
+	if loc == nil {
+		return "", fmt.Errorf("can't find the target table of insert: %s", query)
+	}
+	prefix := query[loc[2]:loc[3]]
+	table := query[loc[4]:loc[5]]
+	return prefix + "`" + shadowDatabase + "`." + table + query[loc[1]:], nil
+}
+
+// arrayParam formats values as an Array(String) query parameter
+func arrayParam(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		v = strings.ReplaceAll(v, `'`, `\'`)
+		quoted = append(quoted, "'"+v+"'")
+	}
+	return "[" + strings.Join(quoted, ",") + "]"
+}
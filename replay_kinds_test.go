@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsReplayableInsert(t *testing.T) {
+	assert.True(t, isReplayableInsert("INSERT INTO events SELECT * FROM events_buffer"))
+	assert.True(t, isReplayableInsert("  insert into db.events (a, b)\nselect a, b from other"))
+	assert.False(t, isReplayableInsert("INSERT INTO events VALUES"))
+	assert.False(t, isReplayableInsert("INSERT INTO events FORMAT JSONEachRow"))
+	assert.False(t, isReplayableInsert("INSERT INTO FUNCTION remote('host', db.t) SELECT 1"))
+	assert.False(t, isReplayableInsert("SELECT 1"))
+}
+
+func TestRedirectInsert(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "unqualified table",
+			query: "INSERT INTO events SELECT 1",
+			want:  "INSERT INTO `shadow`.events SELECT 1",
+		},
+		{
+			name:  "qualified table",
+			query: "INSERT INTO posthog.events (a) SELECT 1",
+			want:  "INSERT INTO `shadow`.events (a) SELECT 1",
+		},
+		{
+			name:  "quoted names",
+			query: "insert into table `posthog`.`my events` select 1",
+			want:  "insert into table `shadow`.`my events` select 1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redirectInsert(tt.query, "shadow")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := redirectInsert("SELECT 1", "shadow")
+	assert.Error(t, err)
+}
+
+func TestArrayParam(t *testing.T) {
+	assert.Equal(t, `['Select','Insert']`, arrayParam([]string{"Select", "Insert"}))
+	assert.Equal(t, `['it\'s','a\\b']`, arrayParam([]string{"it's", `a\b`}))
+	assert.Equal(t, `[]`, arrayParam(nil))
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	tests := []struct {
+		query   string
+		allowed bool
+	}{
+		{"SELECT 1", true},
+		{"  with x as (select 1) select * from x", true},
+		{"(SELECT 1) UNION ALL (SELECT 2)", true},
+		{"/* dashboard 42 */ -- cached\nSELECT count() FROM events", true},
+		{"INSERT INTO events SELECT * FROM events_buffer", false},
+		{"INSERT INTO FUNCTION remote('host', db.t) SELECT 1", false},
+		{"SYSTEM DROP DNS CACHE", false},
+		{"ALTER TABLE events DELETE WHERE 1", false},
+		{"/* SELECT */ DROP TABLE events", false},
+		{"OPTIMIZE TABLE events FINAL", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			err := checkReadOnly(tt.query)
+			if tt.allowed {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.True(t, strings.HasPrefix(err.Error(), readOnlyRejection))
+			}
+		})
+	}
+}
+
+func TestReplaySettingsReadOnly(t *testing.T) {
+	set := SettingsSet{Name: "default", Settings: map[string]string{"readonly": "0", "max_threads": "4"}}
+	opts := &ReplayOptions{RunID: "run-1"}
+	assert.Equal(t, clickhouse.Settings{"log_comment": "run-1", "readonly": "0", "max_threads": "4"}, replaySettings(opts, set))
+
+	// a settings set can't lift read-only mode
+	opts.ReadOnly = true
+	assert.Equal(t, clickhouse.Settings{"log_comment": "run-1", "readonly": "2", "max_threads": "4"}, replaySettings(opts, set))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// harvestedProfileEvents are the ProfileEvents kept from the query log, the
+// full map has hundreds of entries per query
+var harvestedProfileEvents = []string{
+	"RealTimeMicroseconds",
+	"UserTimeMicroseconds",
+	"SystemTimeMicroseconds",
+	"OSCPUWaitMicroseconds",
+	"SelectedParts",
+	"SelectedRanges",
+	"SelectedMarks",
+	"SelectedRows",
+	"SelectedBytes",
+	"ReadCompressedBytes",
+	"MarkCacheHits",
+	"MarkCacheMisses",
+	"NetworkSendBytes",
+}
+
+// profileEventsExpr selects the harvested ProfileEvents of a query log row
+const profileEventsExpr = "mapFilter((k, v) -> has({profile_events:Array(String)}, k), ProfileEvents)"
+
+// QueryMetrics are the server-side metrics of a query execution as
+// recorded in system.query_log
+type QueryMetrics struct {
+	ReadRows    uint64 `json:"read_rows"`
+	ReadBytes   uint64 `json:"read_bytes"`
+	MemoryUsage uint64 `json:"memory_usage"`
+	// DurationMs is the server-side duration, only harvested for the target
+	// since the source's is the query's original duration
+	DurationMs    uint64            `json:"duration_ms"`
+	ProfileEvents map[string]uint64 `json:"profile_events"`
+}
+
+func profileEventsParam() any {
+	return clickhouse.Named("profile_events", arrayParam(harvestedProfileEvents))
+}
+
+// formatProfileEvents encodes profile events as a JSON object for csv files
+func formatProfileEvents(events map[string]uint64) string {
+	if len(events) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func parseProfileEvents(s string) (map[string]uint64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var events map[string]uint64
+	if err := json.Unmarshal([]byte(s), &events); err != nil {
+		return nil, fmt.Errorf("parsing profile events: %v", err)
+	}
+	return events, nil
+}
+
+// replayQueryID is the query_id a workload record is replayed with. It only
+// depends on the run, so a resumed run reuses the ids of the interrupted one.
+func replayQueryID(runID string, settingsSet int, offset int64) string {
+	return fmt.Sprintf("%s-%d-%d", runID, settingsSet, offset)
+}
+
+// buildTargetMetricsQuery selects the metrics of the run's queries from the
+// target's query log. Queries killed by an interruption and replayed again
+// on resume have several entries, the latest one wins.
+func buildTargetMetricsQuery(opts *ReplayOptions) (string, []any) {
+	queryLog := "system.query_log"
+	params := []any{
+		clickhouse.Named("run_id", opts.RunID),
+		clickhouse.Named("since", opts.RunStarted.UTC().AddDate(0, 0, -1).Format("2006-01-02")),
+		profileEventsParam(),
+	}
+	if opts.TargetCluster != "" {
+		queryLog = "clusterAllReplicas({cluster:String}, system.query_log)"
+		params = append(params, clickhouse.Named("cluster", opts.TargetCluster))
+	}
+	return `
+		select
+			query_id,
+			argMax(read_rows, event_time_microseconds),
+			argMax(read_bytes, event_time_microseconds),
+			argMax(memory_usage, event_time_microseconds),
+			argMax(query_duration_ms, event_time_microseconds),
+			argMax(` + profileEventsExpr + `, event_time_microseconds)
+		from ` + queryLog + `
+		where event_date >= {since:Date} and log_comment = {run_id:String}
+		and type in ('QueryFinish', 'ExceptionWhileProcessing')
+		group by query_id
+		`, params
+}
+
+// queryLogFlushInterval is the server's default flush_interval_milliseconds
+// of system.query_log
+const queryLogFlushInterval = 7500 * time.Millisecond
+
+// flushTargetLogs makes sure the last queries of the run are in the target's
+// query log. Read-only mode sends no statements to the target besides SELECTs
+// and the KILL QUERY of an interrupted replay's own queries, so it waits for
+// the periodic flush instead of running SYSTEM FLUSH LOGS.
+func flushTargetLogs(ctx context.Context, opts *ReplayOptions) error {
+	if opts.ReadOnly {
+		log.Infof("Waiting %s for the target to flush its query log", queryLogFlushInterval)
+		select {
+		case <-time.After(queryLogFlushInterval):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	flush := "SYSTEM FLUSH LOGS"
+	if opts.TargetCluster != "" {
+		flush += " ON CLUSTER `" + opts.TargetCluster + "`"
+	}
+	// without the flush the last queries of the run may not be logged yet
+	if _, err := opts.ToConn.ExecContext(ctx, flush); err != nil {
+		log.Warnf("Flushing logs on the target failed, metrics of the last queries may be missing: %v", err)
+	}
+	return nil
+}
+
+// harvestTargetMetrics reads the server-side metrics of the run's queries
+// from the target, keyed by query_id
+func harvestTargetMetrics(ctx context.Context, opts *ReplayOptions) (map[string]QueryMetrics, error) {
+	if err := flushTargetLogs(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	query, params := buildTargetMetricsQuery(opts)
+	rows, err := opts.ToConn.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("querying target query log: %v", err)
+	}
+	defer rows.Close()
+
+	metrics := make(map[string]QueryMetrics)
+	for rows.Next() {
+		var (
+			queryID string
+			m       QueryMetrics
+		)
+		if err := rows.Scan(&queryID, &m.ReadRows, &m.ReadBytes, &m.MemoryUsage, &m.DurationMs, &m.ProfileEvents); err != nil {
+			return nil, fmt.Errorf("reading target query log: %v", err)
+		}
+		metrics[queryID] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading target query log: %v", err)
+	}
+	return metrics, nil
+}
+
+// annotateResults adds the target's server-side metrics to the results in
+// output.csv. Only the first target's metrics are harvested.
+func annotateResults(path string, metrics map[string]QueryMetrics, compareTargets int) (int, error) {
+	results, err := readResults(path)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, fmt.Errorf("writing results: %v", err)
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	writer.Write(resultsHeader(compareTargets))
+	matched := 0
+	for i, r := range results {
+		if m, ok := metrics[r.queryID]; ok {
+			r.targetMetrics = m
+			matched++
+		}
+		writer.Write(resultRecord(i+1, r))
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return 0, fmt.Errorf("writing results: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("writing results: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, fmt.Errorf("writing results: %v", err)
+	}
+	return matched, nil
+}
+
+// newRunID names a replay run, it is sent as the log_comment of every
+// replayed query
+func newRunID(started time.Time) string {
+	return "synch-replay-" + started.UTC().Format("20060102-150405")
+}
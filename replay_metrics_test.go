@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayQueryID(t *testing.T) {
+	started := time.Date(2023, 10, 1, 12, 30, 5, 0, time.UTC)
+	runID := newRunID(started)
+	assert.Equal(t, "synch-replay-20231001-123005", runID)
+	assert.Equal(t, "synch-replay-20231001-123005-1-42", replayQueryID(runID, 1, 42))
+	assert.Equal(t, replayQueryID(runID, 1, 42), replayQueryID(runID, 1, 42))
+	assert.NotEqual(t, replayQueryID(runID, 0, 42), replayQueryID(runID, 1, 42))
+}
+
+func TestBuildTargetMetricsQuery(t *testing.T) {
+	opts := &ReplayOptions{
+		RunID:      "run",
+		RunStarted: time.Date(2023, 10, 1, 0, 30, 0, 0, time.UTC),
+	}
+	query, params := buildTargetMetricsQuery(opts)
+	assert.Contains(t, query, "from system.query_log")
+	assert.Contains(t, query, "log_comment = {run_id:String}")
+	assert.Equal(t, []any{
+		clickhouse.Named("run_id", "run"),
+		clickhouse.Named("since", "2023-09-30"),
+		profileEventsParam(),
+	}, params)
+
+	opts.TargetCluster = "target"
+	query, params = buildTargetMetricsQuery(opts)
+	assert.Contains(t, query, "from clusterAllReplicas({cluster:String}, system.query_log)")
+	assert.Contains(t, params, clickhouse.Named("cluster", "target"))
+}
+
+func TestAnnotateResults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.csv")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	w := csv.NewWriter(file)
+	w.Write(resultsHeader(0))
+	w.Write(resultRecord(1, QueryResult{
+		queryID:       "run-0-0",
+		query:         "SELECT 1",
+		sourceMetrics: QueryMetrics{ReadRows: 10, ProfileEvents: map[string]uint64{"SelectedParts": 1}},
+	}))
+	w.Write(resultRecord(2, QueryResult{queryID: "run-0-1", query: "SELECT 2"}))
+	w.Flush()
+	require.NoError(t, file.Close())
+
+	target := QueryMetrics{
+		ReadRows:      12,
+		ReadBytes:     96,
+		MemoryUsage:   2048,
+		DurationMs:    5,
+		ProfileEvents: map[string]uint64{"SelectedParts": 2},
+	}
+	matched, err := annotateResults(path, map[string]QueryMetrics{"run-0-0": target}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, matched)
+
+	results, err := readResults(path)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, target, results[0].targetMetrics)
+	assert.Equal(t, uint64(10), results[0].sourceMetrics.ReadRows)
+	assert.Equal(t, map[string]uint64{"SelectedParts": 1}, results[0].sourceMetrics.ProfileEvents)
+	assert.Equal(t, QueryMetrics{}, results[1].targetMetrics)
+	assert.Equal(t, "SELECT 2", results[1].query)
+}
+
+func TestFlushTargetLogsReadOnly(t *testing.T) {
+	// read-only mode never sends SYSTEM FLUSH LOGS, ToConn is nil here
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := flushTargetLogs(ctx, &ReplayOptions{ReadOnly: true})
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// progressWindow is the period the rolling p95 and error rate cover
+const progressWindow = time.Minute
+
+// replayProgress follows a running replay for the progress log and the
+// metrics endpoint
+type replayProgress struct {
+	runID string
+
+	mu          sync.Mutex
+	settingsSet string
+	dispatched  uint64
+	completed   uint64
+	errors      uint64
+	virtualTime time.Time
+	lag         time.Duration
+	window      []progressSample
+}
+
+type progressSample struct {
+	at         time.Time
+	durationMs uint64
+	errored    bool
+}
+
+// progressSnapshot is the state of a replay at a point in time
+type progressSnapshot struct {
+	SettingsSet string
+	Dispatched  uint64
+	Completed   uint64
+	Errors      uint64
+	InFlight    uint64
+	VirtualTime time.Time
+	// Lag is how far dispatching is behind the workload's timeline
+	Lag time.Duration
+	// WindowErrorRate and WindowP95Ms cover the queries completed in the
+	// last progressWindow
+	WindowErrorRate float64
+	WindowP95Ms     uint64
+}
+
+func newReplayProgress(runID string) *replayProgress {
+	return &replayProgress{runID: runID}
+}
+
+// dispatch records a query handed to the workers. virtualTime is zero when
+// the replay doesn't follow the workload's timeline.
+func (p *replayProgress) dispatch(q Query, virtualTime time.Time) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settingsSet = q.settingsSet
+	p.dispatched++
+	if !virtualTime.IsZero() {
+		p.virtualTime = virtualTime
+		p.lag = max(virtualTime.Sub(q.queryStartTime), 0)
+	}
+}
+
+func (p *replayProgress) complete(r QueryResult, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.completed++
+	if r.queryErrored {
+		p.errors++
+	}
+	p.window = append(p.window, progressSample{at: now, durationMs: r.replayDurationMs, errored: r.queryErrored})
+	p.prune(now)
+}
+
+// prune drops the samples that fell out of the window
+func (p *replayProgress) prune(now time.Time) {
+	i := sort.Search(len(p.window), func(i int) bool { return now.Sub(p.window[i].at) < progressWindow })
+	p.window = p.window[i:]
+}
+
+func (p *replayProgress) snapshot(now time.Time) progressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune(now)
+	s := progressSnapshot{
+		SettingsSet: p.settingsSet,
+		Dispatched:  p.dispatched,
+		Completed:   p.completed,
+		Errors:      p.errors,
+		VirtualTime: p.virtualTime,
+		Lag:         p.lag,
+	}
+	if p.dispatched > p.completed {
+		s.InFlight = p.dispatched - p.completed
+	}
+	var (
+		durations []uint64
+		errored   int
+	)
+	for _, sample := range p.window {
+		if sample.errored {
+			errored++
+			continue
+		}
+		durations = append(durations, sample.durationMs)
+	}
+	if len(p.window) > 0 {
+		s.WindowErrorRate = float64(errored) / float64(len(p.window))
+	}
+	s.WindowP95Ms = durationStats(durations).P95
+	return s
+}
+
+// progressSink feeds the results of a replay into its progress, the
+// results of cancelled queries never reach it
+type progressSink struct {
+	progress *replayProgress
+}
+
+func (s progressSink) Write(number int, r QueryResult) error {
+	s.progress.complete(r, time.Now())
+	return nil
+}
+
+func (s progressSink) Flush() error { return nil }
+func (s progressSink) Close() error { return nil }
+
+// reportProgress logs the progress of the replay every interval until ctx
+// is cancelled
+func reportProgress(ctx context.Context, p *replayProgress, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s := p.snapshot(time.Now())
+		msg := fmt.Sprintf("Progress [%s]: %d dispatched, %d completed, %d in flight, %d errors; last %s: p95 %dms, error rate %.2f%%",
+			s.SettingsSet, s.Dispatched, s.Completed, s.InFlight, s.Errors, progressWindow, s.WindowP95Ms, s.WindowErrorRate*100)
+		if !s.VirtualTime.IsZero() {
+			msg += fmt.Sprintf("; virtual time %s, lag %s", s.VirtualTime.Format("2006-01-02 15:04:05"), s.Lag.Round(time.Millisecond))
+		}
+		log.Info(msg)
+	}
+}
+
+// writeMetrics writes the progress in the Prometheus text format. The
+// metrics cover the whole run, so the settings set being replayed is only a
+// label of synch_replay_info: on the counters every new settings set would
+// start a series at the running total.
+func writeMetrics(w io.Writer, runID string, s progressSnapshot) {
+	labels := fmt.Sprintf(`{run_id=%q}`, runID)
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %g\n", name, help, name, kind, name, labels, value)
+	}
+	fmt.Fprintf(w, "# HELP synch_replay_info The settings set being replayed.\n# TYPE synch_replay_info gauge\nsynch_replay_info{run_id=%q,settings_set=%q} 1\n", runID, s.SettingsSet)
+	metric("synch_replay_dispatched_total", "counter", "Queries handed to the workers.", float64(s.Dispatched))
+	metric("synch_replay_completed_total", "counter", "Queries that completed on the target.", float64(s.Completed))
+	metric("synch_replay_errors_total", "counter", "Queries that errored on the target.", float64(s.Errors))
+	metric("synch_replay_in_flight", "gauge", "Queries dispatched but not completed yet.", float64(s.InFlight))
+	metric("synch_replay_lag_seconds", "gauge", "How far dispatching is behind the workload's timeline.", s.Lag.Seconds())
+	virtualTime := 0.0
+	if !s.VirtualTime.IsZero() {
+		virtualTime = float64(s.VirtualTime.UnixMilli()) / 1000
+	}
+	metric("synch_replay_virtual_time_seconds", "gauge", "Position of the replay on the workload's timeline, as a unix timestamp.", virtualTime)
+	metric("synch_replay_window_p95_seconds", "gauge", "p95 duration of the queries completed in the last minute.", float64(s.WindowP95Ms)/1000)
+	metric("synch_replay_window_error_rate", "gauge", "Error rate of the queries completed in the last minute.", s.WindowErrorRate)
+}
+
+func (p *replayProgress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, p.runID, p.snapshot(time.Now()))
+}
+
+// serveMetrics exposes the progress on addr at /metrics until ctx is
+// cancelled
+func serveMetrics(ctx context.Context, addr string, p *replayProgress) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("starting metrics endpoint: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warnf("Metrics endpoint stopped: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Infof("Serving replay metrics on http://%s/metrics", listener.Addr())
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayProgressSnapshot(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := newReplayProgress("run-1")
+	for i := 0; i < 4; i++ {
+		p.dispatch(Query{settingsSet: "default", queryStartTime: now.Add(-3 * time.Second)}, now)
+	}
+
+	// completed outside the window, only counted in the totals
+	p.complete(QueryResult{replayDurationMs: 5000, queryErrored: true}, now.Add(-2*progressWindow))
+	p.complete(QueryResult{replayDurationMs: 100}, now)
+	p.complete(QueryResult{replayDurationMs: 200, queryErrored: true}, now)
+
+	s := p.snapshot(now)
+	assert.Equal(t, progressSnapshot{
+		SettingsSet:     "default",
+		Dispatched:      4,
+		Completed:       3,
+		Errors:          2,
+		InFlight:        1,
+		VirtualTime:     now,
+		Lag:             3 * time.Second,
+		WindowErrorRate: 0.5,
+		WindowP95Ms:     100,
+	}, s)
+
+	// replays that don't follow the timeline have no lag
+	p.dispatch(Query{settingsSet: "default"}, time.Time{})
+	assert.Equal(t, 3*time.Second, p.snapshot(now).Lag)
+}
+
+func TestWriteMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	writeMetrics(&buf, "run-1", progressSnapshot{
+		SettingsSet: "default",
+		Dispatched:  10,
+		Completed:   8,
+		InFlight:    2,
+		Lag:         1500 * time.Millisecond,
+		WindowP95Ms: 250,
+	})
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE synch_replay_dispatched_total counter\n")
+	assert.Contains(t, out, `synch_replay_info{run_id="run-1",settings_set="default"} 1`+"\n")
+	assert.Contains(t, out, `synch_replay_dispatched_total{run_id="run-1"} 10`+"\n")
+	assert.Contains(t, out, `synch_replay_in_flight{run_id="run-1"} 2`+"\n")
+	assert.Contains(t, out, `synch_replay_lag_seconds{run_id="run-1"} 1.5`+"\n")
+	assert.Contains(t, out, `synch_replay_window_p95_seconds{run_id="run-1"} 0.25`+"\n")
+	assert.Contains(t, out, `synch_replay_virtual_time_seconds{run_id="run-1"} 0`+"\n")
+}
+
+func TestReplayProgressServeHTTP(t *testing.T) {
+	p := newReplayProgress("run-1")
+	p.dispatch(Query{settingsSet: "default"}, time.Time{})
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+	assert.Contains(t, rec.Body.String(), `synch_replay_dispatched_total{run_id="run-1"} 1`)
+}
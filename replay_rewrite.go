@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule is one entry of a rewrite rules file. Which fields are used
+// depends on Type:
+//
+//	literal          replace every occurrence of From with To
+//	regex            replace matches of the regular expression From with To, which may use $1 style references
+//	remove_setting   drop setting Name from the query's SETTINGS clause
+//	set_setting      set setting Name to Value, adding it to the SETTINGS clause if needed
+//	rename_database  replace references to database From with database To
+//	rename_table     replace references to table From (optionally database qualified) with To
+type RewriteRule struct {
+	Type  string `json:"type"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+func (r RewriteRule) String() string {
+	switch r.Type {
+	case "remove_setting":
+		return fmt.Sprintf("remove_setting(%s)", r.Name)
+	case "set_setting":
+		return fmt.Sprintf("set_setting(%s=%s)", r.Name, r.Value)
+	default:
+		return fmt.Sprintf("%s(%s => %s)", r.Type, r.From, r.To)
+	}
+}
+
+type compiledRewriteRule struct {
+	rule  RewriteRule
+	apply func(query string) string
+}
+
+// queryRewriter applies rewrite rules, in file order, to queries before
+// they are replayed
+type queryRewriter struct {
+	rules []compiledRewriteRule
+}
+
+// defaultRewriteRules run before the rules of the rewrite rules file unless
+// they are turned off. PostHog's queries set allow_experimental_object_type,
+// which ClickHouse Cloud rejects.
+var defaultRewriteRules = []RewriteRule{
+	{Type: "remove_setting", Name: "allow_experimental_object_type"},
+}
+
+// replayRewriter builds the rewriter of a replay from the default rules,
+// when enabled, followed by the rules in file, if any
+func replayRewriter(file string, defaults bool) (*queryRewriter, error) {
+	var rules []RewriteRule
+	if defaults {
+		rules = append(rules, defaultRewriteRules...)
+	}
+	if file != "" {
+		fileRules, err := loadRewriteRules(file)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, fileRules...)
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return newQueryRewriter(rules)
+}
+
+func loadRewriteRules(file string) ([]RewriteRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading rewrite rules: %v", err)
+	}
+	var rules []RewriteRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing rewrite rules: %v", err)
+	}
+	return rules, nil
+}
+
+func newQueryRewriter(rules []RewriteRule) (*queryRewriter, error) {
+	rewriter := &queryRewriter{}
+	for i, rule := range rules {
+		rule := rule
+		compiled := compiledRewriteRule{rule: rule}
+		switch rule.Type {
+		case "literal":
+			if rule.From == "" {
+				return nil, fmt.Errorf("rewrite rule %d: literal rules need from", i+1)
+			}
+			compiled.apply = func(query string) string {
+				return strings.ReplaceAll(query, rule.From, rule.To)
+			}
+		case "regex":
+			re, err := regexp.Compile(rule.From)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule %d: %v", i+1, err)
+			}
+			compiled.apply = func(query string) string {
+				return re.ReplaceAllString(query, rule.To)
+			}
+		case "remove_setting":
+			if rule.Name == "" {
+				return nil, fmt.Errorf("rewrite rule %d: remove_setting rules need name", i+1)
+			}
+			compiled.apply = func(query string) string {
+				return removeSetting(query, rule.Name)
+			}
+		case "set_setting":
+			if rule.Name == "" {
+				return nil, fmt.Errorf("rewrite rule %d: set_setting rules need name", i+1)
+			}
+			compiled.apply = func(query string) string {
+				return setSetting(query, rule.Name, rule.Value)
+			}
+		case "rename_database":
+			if rule.From == "" || rule.To == "" {
+				return nil, fmt.Errorf("rewrite rule %d: rename_database rules need from and to", i+1)
+			}
+			re := regexp.MustCompile("(^|[^\\w.`])`?" + regexp.QuoteMeta(rule.From) + "`?\\.")
+			compiled.apply = func(query string) string {
+				return re.ReplaceAllString(query, "${1}"+strings.ReplaceAll(rule.To, "$", "$$")+".")
+			}
+		case "rename_table":
+			if rule.From == "" || rule.To == "" {
+				return nil, fmt.Errorf("rewrite rule %d: rename_table rules need from and to", i+1)
+			}
+			re := regexp.MustCompile("(^|[^\\w.`])" + qualifiedNamePattern(rule.From) + "([^\\w`]|$)")
+			compiled.apply = func(query string) string {
+				return re.ReplaceAllString(query, "${1}"+strings.ReplaceAll(rule.To, "$", "$$")+"${2}")
+			}
+		default:
+			return nil, fmt.Errorf("rewrite rule %d: unknown rule type '%s'", i+1, rule.Type)
+		}
+		rewriter.rules = append(rewriter.rules, compiled)
+	}
+	return rewriter, nil
+}
+
+// rewrite applies all rules to query and returns the rewritten query along
+// with the rules that changed it
+func (r *queryRewriter) rewrite(query string) (string, []string) {
+	var applied []string
+	if r == nil {
+		return query, applied
+	}
+	for _, rule := range r.rules {
+		rewritten := rule.apply(query)
+		if rewritten != query {
+			applied = append(applied, rule.rule.String())
+			query = rewritten
+		}
+	}
+	return query, applied
+}
+
+// qualifiedNamePattern matches a possibly database qualified name with or
+// without backticks around each part
+func qualifiedNamePattern(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`?" + regexp.QuoteMeta(part) + "`?"
+	}
+	return strings.Join(parts, `\.`)
+}
+
+var (
+	settingsKeywordRe = regexp.MustCompile(`(?i)\bSETTINGS\s+`)
+	formatKeywordRe   = regexp.MustCompile(`(?i)\s+FORMAT\s+\w+\s*;?\s*$`)
+	settingItemRe     = regexp.MustCompile(`^\s*(\w+)\s*=\s*('(?:[^'\\]|\\.)*'|[^\s,']+)\s*(?:,|$)`)
+)
+
+type querySetting struct {
+	name  string
+	value string
+}
+
+// settingsClause locates the SETTINGS clause of the outermost query. It
+// returns the offsets of the SETTINGS keyword and of the start and end of
+// the settings list, or nil if the query has no such clause.
+func settingsClause(query string) []int {
+	matches := settingsKeywordRe.FindAllStringIndex(query, -1)
+	if len(matches) == 0 {
+		return nil
+	}
+	last := matches[len(matches)-1]
+	tail := query[last[1]:]
+	// a SETTINGS clause followed by parentheses belongs to a subquery
+	if strings.ContainsAny(tail, "()") {
+		return nil
+	}
+	end := len(query)
+	if loc := formatKeywordRe.FindStringIndex(tail); loc != nil {
+		end = last[1] + loc[0]
+	}
+	end = last[1] + len(strings.TrimRight(strings.TrimRight(query[last[1]:end], " \t\r\n;"), " \t\r\n"))
+	return []int{last[0], last[1], end}
+}
+
+func parseSettings(list string) ([]querySetting, bool) {
+	var settings []querySetting
+	for strings.TrimSpace(list) != "" {
+		m := settingItemRe.FindStringSubmatch(list)
+		if m == nil {
+			return nil, false
+		}
+		settings = append(settings, querySetting{name: m[1], value: m[2]})
+		list = list[len(m[0]):]
+	}
+	return settings, true
+}
+
+func renderSettings(settings []querySetting) string {
+	items := make([]string, 0, len(settings))
+	for _, s := range settings {
+		items = append(items, s.name+"="+s.value)
+	}
+	return strings.Join(items, ", ")
+}
+
+func removeSetting(query, name string) string {
+	loc := settingsClause(query)
+	if loc == nil {
+		return query
+	}
+	settings, ok := parseSettings(query[loc[1]:loc[2]])
+	if !ok {
+		return query
+	}
+	var kept []querySetting
+	for _, s := range settings {
+		if !strings.EqualFold(s.name, name) {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == len(settings) {
+		return query
+	}
+	if len(kept) == 0 {
+		return strings.TrimRight(query[:loc[0]], " \t\r\n") + query[loc[2]:]
+	}
+	return query[:loc[1]] + renderSettings(kept) + query[loc[2]:]
+}
+
+func setSetting(query, name, value string) string {
+	loc := settingsClause(query)
+	if loc == nil {
+		body := strings.TrimRight(query, " \t\r\n;")
+		end := len(body)
+		if f := formatKeywordRe.FindStringIndex(body); f != nil {
+			end = f[0]
+		}
+		return body[:end] + " SETTINGS " + name + "=" + value + body[end:]
+	}
+	settings, ok := parseSettings(query[loc[1]:loc[2]])
+	if !ok {
+		return query
+	}
+	found := false
+	for i, s := range settings {
+		if strings.EqualFold(s.name, name) {
+			settings[i].value = value
+			found = true
+		}
+	}
+	if !found {
+		settings = append(settings, querySetting{name: name, value: value})
+	}
+	return query[:loc[1]] + renderSettings(settings) + query[loc[2]:]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveSetting(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "last setting",
+			query: "SELECT 1 SETTINGS max_threads=8, allow_experimental_object_type=1",
+			want:  "SELECT 1 SETTINGS max_threads=8",
+		},
+		{
+			name:  "first setting",
+			query: "SELECT 1 SETTINGS allow_experimental_object_type = 1, max_threads=8",
+			want:  "SELECT 1 SETTINGS max_threads=8",
+		},
+		{
+			name:  "only setting",
+			query: "SELECT 1 SETTINGS allow_experimental_object_type=1",
+			want:  "SELECT 1",
+		},
+		{
+			name:  "only setting before format",
+			query: "SELECT 1 SETTINGS allow_experimental_object_type=1 FORMAT JSON",
+			want:  "SELECT 1 FORMAT JSON",
+		},
+		{
+			name:  "not present",
+			query: "SELECT 1 SETTINGS max_threads=8",
+			want:  "SELECT 1 SETTINGS max_threads=8",
+		},
+		{
+			name:  "subquery settings are left alone",
+			query: "SELECT * FROM (SELECT 1 SETTINGS allow_experimental_object_type=1)",
+			want:  "SELECT * FROM (SELECT 1 SETTINGS allow_experimental_object_type=1)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, removeSetting(tt.query, "allow_experimental_object_type"))
+		})
+	}
+}
+
+func TestSetSetting(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{
+			name:  "no settings clause",
+			query: "SELECT 1;",
+			want:  "SELECT 1 SETTINGS max_threads=4",
+		},
+		{
+			name:  "no settings clause with format",
+			query: "SELECT 1 FORMAT JSON",
+			want:  "SELECT 1 SETTINGS max_threads=4 FORMAT JSON",
+		},
+		{
+			name:  "appended to existing clause",
+			query: "SELECT 1 SETTINGS log_comment='a, b'",
+			want:  "SELECT 1 SETTINGS log_comment='a, b', max_threads=4",
+		},
+		{
+			name:  "overridden",
+			query: "SELECT 1 SETTINGS max_threads = 16, use_uncompressed_cache=1",
+			want:  "SELECT 1 SETTINGS max_threads=4, use_uncompressed_cache=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, setSetting(tt.query, "max_threads", "4"))
+		})
+	}
+}
+
+func TestQueryRewriter(t *testing.T) {
+	rewriter, err := replayRewriter("testdata/rewrite_rules.json", false)
+	assert.NoError(t, err)
+
+	query, applied := rewriter.rewrite("SELECT toStartOfDay(timestamp) FROM `posthog`.`sharded_events` FINAL JOIN posthog.persons p ON 1 SETTINGS allow_experimental_object_type=1")
+	assert.Equal(t, "SELECT toDate(timestamp) FROM posthog_bench.events  JOIN posthog_bench.persons p ON 1 SETTINGS max_threads=8", query)
+	assert.Equal(t, []string{
+		"remove_setting(allow_experimental_object_type)",
+		"set_setting(max_threads=8)",
+		"rename_database(posthog => posthog_bench)",
+		"rename_table(posthog_bench.sharded_events => posthog_bench.events)",
+		"literal(FINAL => )",
+		`regex(toStartOfDay\((\w+)\) => toDate($1))`,
+	}, applied)
+
+	// queries no rule matches are left untouched
+	query, applied = rewriter.rewrite("SELECT 1 SETTINGS max_threads=8")
+	assert.Equal(t, "SELECT 1 SETTINGS max_threads=8", query)
+	assert.Empty(t, applied)
+
+	_, err = newQueryRewriter([]RewriteRule{{Type: "unknown"}})
+	assert.Error(t, err)
+	_, err = newQueryRewriter([]RewriteRule{{Type: "regex", From: "("}})
+	assert.Error(t, err)
+}
+
+func TestDefaultRewriteRules(t *testing.T) {
+	query := "SELECT 1 SETTINGS allow_experimental_object_type=1, max_threads=8"
+
+	// the defaults apply without a rewrite rules file
+	rewriter, err := replayRewriter("", true)
+	assert.NoError(t, err)
+	rewritten, applied := rewriter.rewrite(query)
+	assert.Equal(t, "SELECT 1 SETTINGS max_threads=8", rewritten)
+	assert.Equal(t, []string{"remove_setting(allow_experimental_object_type)"}, applied)
+
+	// and before the rules of the file
+	rewriter, err = replayRewriter("testdata/rewrite_rules.json", true)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultRewriteRules[0], rewriter.rules[0].rule)
+
+	// turning them off leaves the query untouched
+	rewriter, err = replayRewriter("", false)
+	assert.NoError(t, err)
+	rewritten, applied = rewriter.rewrite(query)
+	assert.Equal(t, query, rewritten)
+	assert.Empty(t, applied)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// WorkloadSampling selects a representative subset of the query log to
+// replay. Every choice is derived from a hash of the query text, its start
+// time and Seed, so the same seed always selects the same subset.
+type WorkloadSampling struct {
+	// SamplePercent keeps roughly this percentage of executions, 0 keeps all
+	SamplePercent float64 `json:"sample_percent"`
+	// TopShapes keeps only the query shapes with the highest total duration
+	TopShapes int `json:"top_shapes"`
+	// MaxPerShape caps the executions kept per normalized query hash
+	MaxPerShape  int      `json:"max_per_shape"`
+	Users        []string `json:"users"`
+	InitialUsers []string `json:"initial_users"`
+	Databases    []string `json:"databases"`
+	Seed         uint64   `json:"seed"`
+}
+
+func (s WorkloadSampling) validate() error {
+	if s.SamplePercent < 0 || s.SamplePercent > 100 {
+		return fmt.Errorf("sample percentage must be between 0 and 100, got %v", s.SamplePercent)
+	}
+	if s.TopShapes < 0 {
+		return fmt.Errorf("number of top query shapes can't be negative, got %d", s.TopShapes)
+	}
+	if s.MaxPerShape < 0 {
+		return fmt.Errorf("maximum executions per query shape can't be negative, got %d", s.MaxPerShape)
+	}
+	return nil
+}
+
+// filters returns the predicates restricting which query log entries are
+// considered at all, along with their query parameters
+func (s WorkloadSampling) filters() (string, []any) {
+	var (
+		predicates string
+		params     []any
+	)
+	if len(s.Users) > 0 {
+		predicates += "\n\t\tand user in {users:Array(String)}"
+		params = append(params, clickhouse.Named("users", arrayParam(s.Users)))
+	}
+	if len(s.InitialUsers) > 0 {
+		predicates += "\n\t\tand initial_user in {initial_users:Array(String)}"
+		params = append(params, clickhouse.Named("initial_users", arrayParam(s.InitialUsers)))
+	}
+	if len(s.Databases) > 0 {
+		predicates += "\n\t\tand current_database in {databases:Array(String)}"
+		params = append(params, clickhouse.Named("databases", arrayParam(s.Databases)))
+	}
+	return predicates, params
+}
+
+// sampleKey is the expression executions are sampled and ranked by
+func (s WorkloadSampling) sampleKey() string {
+	return "cityHash64(query, query_start_time_microseconds, {seed:UInt64})"
+}
+
+func (s WorkloadSampling) seedParam() any {
+	return clickhouse.Named("seed", strconv.FormatUint(s.Seed, 10))
+}
+
+func (s WorkloadSampling) usesSeed() bool {
+	return s.sampling() || s.MaxPerShape > 0
+}
+
+func (s WorkloadSampling) sampling() bool {
+	return s.SamplePercent > 0 && s.SamplePercent < 100
+}
+
+// samplePermyriad is the sample percentage in hundredths of a percent
+func (s WorkloadSampling) samplePermyriad() string {
+	return strconv.FormatUint(uint64(s.SamplePercent*100), 10)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// SettingsSet is a named combination of ClickHouse settings a workload is
+// replayed with
+type SettingsSet struct {
+	Name     string            `json:"name"`
+	Settings map[string]string `json:"settings"`
+}
+
+func (s SettingsSet) clickhouseSettings() clickhouse.Settings {
+	settings := make(clickhouse.Settings, len(s.Settings))
+	for k, v := range s.Settings {
+		settings[k] = v
+	}
+	return settings
+}
+
+// parseSettingFlags parses repeated --setting key=value flags
+func parseSettingFlags(flags []string) (map[string]string, error) {
+	settings := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid setting '%s', expected key=value", flag)
+		}
+		settings[key] = strings.TrimSpace(value)
+	}
+	return settings, nil
+}
+
+// loadSettingsMatrix reads a JSON list of settings sets, e.g.
+//
+//	[{"name": "baseline", "settings": {}}, {"name": "parallel_replicas", "settings": {"max_parallel_replicas": "6"}}]
+func loadSettingsMatrix(file string) ([]SettingsSet, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading settings matrix: %v", err)
+	}
+	var matrix []SettingsSet
+	if err := json.Unmarshal(data, &matrix); err != nil {
+		return nil, fmt.Errorf("parsing settings matrix: %v", err)
+	}
+	seen := map[string]bool{}
+	for i, set := range matrix {
+		if set.Name == "" {
+			return nil, fmt.Errorf("settings set %d has no name", i+1)
+		}
+		if seen[set.Name] {
+			return nil, fmt.Errorf("settings set name '%s' is used more than once", set.Name)
+		}
+		seen[set.Name] = true
+	}
+	return matrix, nil
+}
+
+// buildSettingsSets combines the settings given on the command line with
+// the sets of a settings matrix. Settings from the matrix take precedence.
+// Without a matrix a single set holding the command line settings is used.
+func buildSettingsSets(base map[string]string, matrix []SettingsSet) []SettingsSet {
+	if len(matrix) == 0 {
+		return []SettingsSet{{Name: settingsSetName(base), Settings: base}}
+	}
+	sets := make([]SettingsSet, 0, len(matrix))
+	for _, set := range matrix {
+		merged := make(map[string]string, len(base)+len(set.Settings))
+		for k, v := range base {
+			merged[k] = v
+		}
+		for k, v := range set.Settings {
+			merged[k] = v
+		}
+		sets = append(sets, SettingsSet{Name: set.Name, Settings: merged})
+	}
+	return sets
+}
+
+// settingsSetName names an unnamed settings set after its settings
+func settingsSetName(settings map[string]string) string {
+	if len(settings) == 0 {
+		return "default"
+	}
+	items := make([]string, 0, len(settings))
+	for k, v := range settings {
+		items = append(items, k+"="+v)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
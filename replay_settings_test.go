@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSettingFlags(t *testing.T) {
+	got, err := parseSettingFlags([]string{"max_threads=8", " log_comment = a=b "})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"max_threads": "8", "log_comment": "a=b"}, got)
+
+	_, err = parseSettingFlags([]string{"max_threads"})
+	assert.Error(t, err)
+	_, err = parseSettingFlags([]string{"=8"})
+	assert.Error(t, err)
+}
+
+func TestBuildSettingsSets(t *testing.T) {
+	base := map[string]string{"max_threads": "8", "use_uncompressed_cache": "0"}
+
+	assert.Equal(t, []SettingsSet{{Name: "default", Settings: map[string]string{}}}, buildSettingsSets(map[string]string{}, nil))
+	assert.Equal(t, []SettingsSet{{Name: "max_threads=8,use_uncompressed_cache=0", Settings: base}}, buildSettingsSets(base, nil))
+
+	matrix := []SettingsSet{
+		{Name: "baseline"},
+		{Name: "more_threads", Settings: map[string]string{"max_threads": "16"}},
+	}
+	assert.Equal(t, []SettingsSet{
+		{Name: "baseline", Settings: map[string]string{"max_threads": "8", "use_uncompressed_cache": "0"}},
+		{Name: "more_threads", Settings: map[string]string{"max_threads": "16", "use_uncompressed_cache": "0"}},
+	}, buildSettingsSets(base, matrix))
+}
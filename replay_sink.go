@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resultSinks are the sinks results can be written to besides output.csv,
+// which is always written since resuming, harvesting metrics and
+// replay-diff read it
+var resultSinks = []string{"jsonl", "clickhouse"}
+
+// clickhouseSinkBatchSize is the number of rows inserted at once by the
+// ClickHouse sink when no checkpoint flushes it earlier
+const clickhouseSinkBatchSize = 1000
+
+// ResultSink receives the results of a replay in the order they complete
+type ResultSink interface {
+	Write(number int, r QueryResult) error
+	// Flush makes the results written so far durable
+	Flush() error
+	Close() error
+}
+
+// fileSink is a ResultSink writing to a file of the run directory. A
+// resumed replay truncates the file to the size recorded in the checkpoint.
+type fileSink interface {
+	ResultSink
+	name() string
+	size() (int64, error)
+}
+
+func validateSinks(sinks []string) error {
+	for _, sink := range sinks {
+		if !includes(resultSinks, sink) {
+			return fmt.Errorf("unknown result sink '%s', supported sinks are %s", sink, strings.Join(resultSinks, ", "))
+		}
+	}
+	return nil
+}
+
+// openSinks opens output.csv and the additional sinks of opts
+func openSinks(ctx context.Context, opts *ReplayOptions, resume *replayCheckpoint) ([]ResultSink, error) {
+	var sinks []ResultSink
+	closeAll := func() {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}
+	csvSink, err := openCSVSink(opts.runPath("output.csv"), resume, opts.CompareTargets)
+	if err != nil {
+		return nil, fmt.Errorf("opening results file: %v", err)
+	}
+	sinks = append(sinks, csvSink)
+	for _, name := range opts.Sinks {
+		if resume != nil && includes(resume.DroppedSinks, name) {
+			log.Warnf("Resuming without the %s result sink, it was dropped after failing", name)
+			continue
+		}
+		var sink ResultSink
+		switch name {
+		case "jsonl":
+			sink, err = openJSONLSink(opts.runPath("output.jsonl"), resume, opts.RunID)
+		case "clickhouse":
+			sink, err = openClickHouseSink(ctx, opts)
+		}
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("opening %s result sink: %v", name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// openSinkFile creates a sink's file and writes its header, or when resuming
+// truncates it to the size recorded in the checkpoint and reopens it for
+// appending
+func openSinkFile(path string, resume *replayCheckpoint, header func(io.Writer) error) (*os.File, error) {
+	if resume == nil {
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := header(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+
+	size, ok := resume.SinkBytes[filepath.Base(path)]
+	if !ok {
+		return nil, fmt.Errorf("the checkpoint has no size for %s, it wasn't written by the replay being resumed", filepath.Base(path))
+	}
+	if err := os.Truncate(path, size); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// position the offset at the end so checkpoints see the current size
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func fileSize(file *os.File) (int64, error) {
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("getting size of %s: %v", file.Name(), err)
+	}
+	return size, nil
+}
+
+// csvSink writes output.csv
+type csvSink struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+func openCSVSink(path string, resume *replayCheckpoint, compareTargets int) (*csvSink, error) {
+	file, err := openSinkFile(path, resume, func(w io.Writer) error {
+		writer := csv.NewWriter(w)
+		writer.Write(resultsHeader(compareTargets))
+		writer.Flush()
+		return writer.Error()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csvSink{file: file, writer: csv.NewWriter(file)}, nil
+}
+
+func (s *csvSink) Write(number int, r QueryResult) error {
+	return s.writer.Write(resultRecord(number, r))
+}
+
+func (s *csvSink) Flush() error {
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *csvSink) Close() error {
+	if err := s.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *csvSink) name() string {
+	return filepath.Base(s.file.Name())
+}
+
+func (s *csvSink) size() (int64, error) {
+	return fileSize(s.file)
+}
+
+// resultRow is a query result as written by the JSONL and ClickHouse sinks
+type resultRow struct {
+	RunID               string        `json:"run_id"`
+	Number              int           `json:"number"`
+	SettingsSet         string        `json:"settings_set"`
+	Stage               int           `json:"stage"`
+	QueryID             string        `json:"query_id"`
+	QueryKind           string        `json:"query_kind"`
+	NormalizedQueryHash uint64        `json:"normalized_query_hash"`
+	OriginalStartTime   time.Time     `json:"original_start_time"`
+	OriginalDurationMs  uint64        `json:"original_duration_ms"`
+	ReplayStartTime     time.Time     `json:"replay_start_time"`
+	ReplayDurationMs    uint64        `json:"replay_duration_ms"`
+	DeltaMs             int64         `json:"delta_ms"`
+	QueryErrored        bool          `json:"query_errored"`
+	Error               string        `json:"error"`
+	Verified            bool          `json:"verified"`
+	ResultRows          uint64        `json:"result_rows"`
+	ResultHash          uint64        `json:"result_hash"`
+	SourceResultRows    uint64        `json:"source_result_rows"`
+	SourceResultHash    uint64        `json:"source_result_hash"`
+	ResultMismatch      bool          `json:"result_mismatch"`
+	VerifyError         string        `json:"verify_error"`
+	SourceMetrics       QueryMetrics  `json:"source_metrics"`
+	Compared            []comparedRow `json:"compared,omitempty"`
+	Rewrites            []string      `json:"rewrites"`
+	Query               string        `json:"query"`
+}
+
+type comparedRow struct {
+	Target           string `json:"target"`
+	ReplayDurationMs uint64 `json:"replay_duration_ms"`
+	QueryErrored     bool   `json:"query_errored"`
+	Error            string `json:"error"`
+	ResultRows       uint64 `json:"result_rows"`
+	ResultHash       uint64 `json:"result_hash"`
+}
+
+func newResultRow(runID string, number int, r QueryResult) resultRow {
+	row := resultRow{
+		RunID:               runID,
+		Number:              number,
+		SettingsSet:         r.settingsSet,
+		Stage:               r.stage,
+		QueryID:             r.queryID,
+		QueryKind:           r.queryKind,
+		NormalizedQueryHash: r.normalizedQueryHash,
+		OriginalStartTime:   r.originalStartTime,
+		OriginalDurationMs:  r.originalDurationMs,
+		ReplayStartTime:     r.replayStartTime,
+		ReplayDurationMs:    r.replayDurationMs,
+		DeltaMs:             r.deltaMs,
+		QueryErrored:        r.queryErrored,
+		Error:               r.errorStr,
+		Verified:            r.verified,
+		ResultRows:          r.rowCount,
+		ResultHash:          r.resultHash,
+		SourceResultRows:    r.sourceRowCount,
+		SourceResultHash:    r.sourceResultHash,
+		ResultMismatch:      r.resultMismatch,
+		VerifyError:         r.verifyErrorStr,
+		SourceMetrics:       r.sourceMetrics,
+		Rewrites:            r.rewrites,
+		Query:               r.query,
+	}
+	if row.Rewrites == nil {
+		row.Rewrites = []string{}
+	}
+	for i, c := range r.compared {
+		row.Compared = append(row.Compared, comparedRow{
+			Target:           compareTargetName(i),
+			ReplayDurationMs: c.replayDurationMs,
+			QueryErrored:     c.queryErrored,
+			Error:            c.errorStr,
+			ResultRows:       c.rowCount,
+			ResultHash:       c.resultHash,
+		})
+	}
+	return row
+}
+
+// jsonlSink writes output.jsonl, one JSON object per result
+type jsonlSink struct {
+	runID  string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func openJSONLSink(path string, resume *replayCheckpoint, runID string) (*jsonlSink, error) {
+	file, err := openSinkFile(path, resume, func(io.Writer) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{runID: runID, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (s *jsonlSink) Write(number int, r QueryResult) error {
+	data, err := json.Marshal(newResultRow(s.runID, number, r))
+	if err != nil {
+		return err
+	}
+	s.writer.Write(data)
+	return s.writer.WriteByte('\n')
+}
+
+func (s *jsonlSink) Flush() error {
+	return s.writer.Flush()
+}
+
+func (s *jsonlSink) Close() error {
+	if err := s.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+func (s *jsonlSink) name() string {
+	return filepath.Base(s.file.Name())
+}
+
+func (s *jsonlSink) size() (int64, error) {
+	return fileSize(s.file)
+}
+
+// quoteIdentifier quotes a possibly database qualified table name
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.ReplaceAll(part, "`", "\\`") + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// clickhouseSink batch inserts results into a table on a results cluster.
+// Rows are keyed by run and number, so the rows a resumed replay writes
+// again replace the earlier ones.
+type clickhouseSink struct {
+	ctx   context.Context
+	conn  *sql.DB
+	table string
+	runID string
+	rows  []resultRow
+}
+
+func clickhouseResultsSchema(table string) string {
+	return `
+		CREATE TABLE IF NOT EXISTS ` + quoteIdentifier(table) + ` (
+			run_id String,
+			number UInt64,
+			settings_set LowCardinality(String),
+			stage UInt32,
+			query_id String,
+			query_kind LowCardinality(String),
+			normalized_query_hash UInt64,
+			original_start_time DateTime64(6, 'UTC'),
+			original_duration_ms UInt64,
+			replay_start_time DateTime64(6, 'UTC'),
+			replay_duration_ms UInt64,
+			delta_ms Int64,
+			query_errored Bool,
+			error String,
+			verified Bool,
+			result_rows UInt64,
+			result_hash UInt64,
+			source_result_rows UInt64,
+			source_result_hash UInt64,
+			result_mismatch Bool,
+			verify_error String,
+			source_read_rows UInt64,
+			source_read_bytes UInt64,
+			source_memory_usage UInt64,
+			source_profile_events Map(String, UInt64),
+			compare_targets Array(String),
+			compare_replay_duration_ms Array(UInt64),
+			compare_query_errored Array(Bool),
+			compare_error Array(String),
+			rewrites Array(String),
+			query String
+		)
+		ENGINE = ReplacingMergeTree
+		ORDER BY (run_id, number)
+		`
+}
+
+func clickhouseRunsSchema(table string) string {
+	return `
+		CREATE TABLE IF NOT EXISTS ` + quoteIdentifier(table+"_runs") + ` (
+			run_id String,
+			run_started DateTime64(6, 'UTC'),
+			run_dir String,
+			config String
+		)
+		ENGINE = ReplacingMergeTree
+		ORDER BY run_id
+		`
+}
+
+func openClickHouseSink(ctx context.Context, opts *ReplayOptions) (*clickhouseSink, error) {
+	if opts.ResultsConn == nil {
+		return nil, fmt.Errorf("the clickhouse sink needs a results cluster url")
+	}
+	for _, ddl := range []string{clickhouseResultsSchema(opts.ResultsTable), clickhouseRunsSchema(opts.ResultsTable)} {
+		if _, err := opts.ResultsConn.ExecContext(ctx, ddl); err != nil {
+			return nil, fmt.Errorf("creating results table: %v", err)
+		}
+	}
+
+	// record the run's options next to its results
+	config, err := json.Marshal(opts)
+	if err != nil {
+		return nil, fmt.Errorf("encoding run config: %v", err)
+	}
+	err = insertRows(ctx, opts.ResultsConn, opts.ResultsTable+"_runs", [][]any{
+		{opts.RunID, opts.RunStarted.UTC(), opts.RunDir, string(config)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &clickhouseSink{
+		// inserts finish even when the replay is interrupted
+		ctx:   context.WithoutCancel(ctx),
+		conn:  opts.ResultsConn,
+		table: opts.ResultsTable,
+		runID: opts.RunID,
+	}, nil
+}
+
+// insertRows batch inserts rows into table in a single insert
+func insertRows(ctx context.Context, conn *sql.DB, table string, rows [][]any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("inserting into %s: %v", table, err)
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+quoteIdentifier(table))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("inserting into %s: %v", table, err)
+	}
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("inserting into %s: %v", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("inserting into %s: %v", table, err)
+	}
+	return nil
+}
+
+func (s *clickhouseSink) Write(number int, r QueryResult) error {
+	s.rows = append(s.rows, newResultRow(s.runID, number, r))
+	if len(s.rows) >= clickhouseSinkBatchSize {
+		return s.Flush()
+	}
+	return nil
+}
+
+// values orders a row's values like the columns of clickhouseResultsSchema
+func (row resultRow) values() []any {
+	var (
+		targets   = []string{}
+		durations = []uint64{}
+		errored   = []bool{}
+		errs      = []string{}
+	)
+	for _, c := range row.Compared {
+		targets = append(targets, c.Target)
+		durations = append(durations, c.ReplayDurationMs)
+		errored = append(errored, c.QueryErrored)
+		errs = append(errs, c.Error)
+	}
+	profileEvents := row.SourceMetrics.ProfileEvents
+	if profileEvents == nil {
+		profileEvents = map[string]uint64{}
+	}
+	return []any{
+		row.RunID,
+		uint64(row.Number),
+		row.SettingsSet,
+		uint32(row.Stage),
+		row.QueryID,
+		row.QueryKind,
+		row.NormalizedQueryHash,
+		row.OriginalStartTime.UTC(),
+		row.OriginalDurationMs,
+		row.ReplayStartTime.UTC(),
+		row.ReplayDurationMs,
+		row.DeltaMs,
+		row.QueryErrored,
+		row.Error,
+		row.Verified,
+		row.ResultRows,
+		row.ResultHash,
+		row.SourceResultRows,
+		row.SourceResultHash,
+		row.ResultMismatch,
+		row.VerifyError,
+		row.SourceMetrics.ReadRows,
+		row.SourceMetrics.ReadBytes,
+		row.SourceMetrics.MemoryUsage,
+		profileEvents,
+		targets,
+		durations,
+		errored,
+		errs,
+		row.Rewrites,
+		row.Query,
+	}
+}
+
+func (s *clickhouseSink) Flush() error {
+	if len(s.rows) == 0 {
+		return nil
+	}
+	rows := make([][]any, 0, len(s.rows))
+	for _, row := range s.rows {
+		rows = append(rows, row.values())
+	}
+	if err := insertRows(s.ctx, s.conn, s.table, rows); err != nil {
+		return err
+	}
+	s.rows = s.rows[:0]
+	return nil
+}
+
+func (s *clickhouseSink) Close() error {
+	return s.Flush()
+}
+
+// sinkSet is the sinks results are written to. output.csv comes first and
+// the replay can't go on without it, the optional sinks after it are closed
+// and dropped with a warning when they fail.
+type sinkSet struct {
+	sinks []ResultSink
+	// dropped are the --sink names of the sinks dropped after failing
+	dropped []string
+}
+
+// sinkKind is the --sink name of an optional sink
+func sinkKind(sink ResultSink) string {
+	switch sink.(type) {
+	case *jsonlSink:
+		return "jsonl"
+	case *clickhouseSink:
+		return "clickhouse"
+	}
+	return fmt.Sprintf("%T", sink)
+}
+
+// each calls f on every sink, returning the error of output.csv
+func (s *sinkSet) each(f func(ResultSink) error) error {
+	kept := make([]ResultSink, 0, len(s.sinks))
+	for i, sink := range s.sinks {
+		err := f(sink)
+		if err == nil {
+			kept = append(kept, sink)
+			continue
+		}
+		if i == 0 {
+			return err
+		}
+		log.Warnf("Disabling the %s result sink, output.csv still gets every result: %v", sinkKind(sink), err)
+		s.dropped = append(s.dropped, sinkKind(sink))
+		if err := sink.Close(); err != nil {
+			log.Warn(err)
+		}
+	}
+	s.sinks = kept
+	return nil
+}
+
+func (s *sinkSet) close() {
+	for _, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// resultWriter writes the results to all sinks, keeps the summary and
+// periodically checkpoints the replay's progress. When output.csv can't be
+// written or flushed, or the checkpoint can't be saved, it stops the replay
+// through fail and only drains the remaining results, so that the checkpoint
+// never counts results missing from output.csv.
+func resultWriter(sinks []ResultSink, results <-chan QueryResult, summary *summaryCollector, tracker *checkpointTracker, i int, wg *sync.WaitGroup, fail context.CancelCauseFunc, done chan<- struct{}) {
+	log.Info("Starting result writer")
+	defer close(done)
+	set := &sinkSet{sinks: sinks}
+	defer set.close()
+
+	// Write all the records
+	failed := false
+	for r := range results {
+		if r.cancelled || failed {
+			wg.Done()
+			continue
+		}
+		number := i + 1
+		if err := set.each(func(sink ResultSink) error { return sink.Write(number, r) }); err != nil {
+			log.Errorf("Stopping the replay, writing output.csv failed: %v", err)
+			fail(fmt.Errorf("writing output.csv: %w", err))
+			failed = true
+			wg.Done()
+			continue
+		}
+		i = number
+		summary.add(r)
+		if tracker != nil {
+			tracker.finished(r.offset)
+			if tracker.due() {
+				if err := saveCheckpoint(set, tracker, i); err != nil {
+					log.Errorf("Stopping the replay, saving the results failed: %v", err)
+					fail(fmt.Errorf("saving results: %w", err))
+					failed = true
+				}
+			}
+		}
+		wg.Done()
+	}
+	if failed {
+		return
+	}
+
+	// output.csv is buffered, the summary mustn't count rows that never reached it
+	var err error
+	if tracker != nil {
+		err = saveCheckpoint(set, tracker, i)
+	} else {
+		err = set.each(ResultSink.Flush)
+	}
+	if err != nil {
+		log.Errorf("Stopping the replay, saving the results failed: %v", err)
+		fail(fmt.Errorf("saving results: %w", err))
+	}
+}
+
+// saveCheckpoint flushes the sinks so that everything the checkpoint
+// counts as written really is, then saves it
+func saveCheckpoint(set *sinkSet, tracker *checkpointTracker, results int) error {
+	if err := set.each(ResultSink.Flush); err != nil {
+		return fmt.Errorf("flushing results: %v", err)
+	}
+	sinkBytes := make(map[string]int64)
+	for _, sink := range set.sinks {
+		if f, ok := sink.(fileSink); ok {
+			size, err := f.size()
+			if err != nil {
+				return err
+			}
+			sinkBytes[f.name()] = size
+		}
+	}
+	tracker.dropSinks(set.dropped)
+	return tracker.save(results, sinkBytes)
+}
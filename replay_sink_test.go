@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSinks(t *testing.T) {
+	assert.NoError(t, validateSinks(nil))
+	assert.NoError(t, validateSinks([]string{"jsonl", "clickhouse"}))
+	assert.Error(t, validateSinks([]string{"parquet"}))
+}
+
+func readJSONL(t *testing.T, path string) []resultRow {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var rows []resultRow
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var row resultRow
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &row))
+		rows = append(rows, row)
+	}
+	require.NoError(t, scanner.Err())
+	return rows
+}
+
+func TestResultWriterSinks(t *testing.T) {
+	dir := t.TempDir()
+	csvSink, err := openCSVSink(filepath.Join(dir, "output.csv"), nil, 1)
+	require.NoError(t, err)
+	jsonl, err := openJSONLSink(filepath.Join(dir, "output.jsonl"), nil, "run-1")
+	require.NoError(t, err)
+
+	results := []QueryResult{
+		{
+			queryKind:           "Select",
+			query:               "SELECT 1",
+			normalizedQueryHash: 7,
+			settingsSet:         "default",
+			replayDurationMs:    12,
+			sourceMetrics:       QueryMetrics{ReadRows: 3, ProfileEvents: map[string]uint64{"SelectedRows": 3}},
+			compared:            []comparedReplay{{replayDurationMs: 6, rowCount: 1}},
+		},
+		{
+			queryKind:    "Select",
+			query:        "SELECT 2",
+			settingsSet:  "default",
+			queryErrored: true,
+			errorStr:     "timeout",
+			compared:     []comparedReplay{{queryErrored: true}},
+		},
+	}
+	summary := newSummaryCollector()
+	tracker := newCheckpointTracker(filepath.Join(dir, "checkpoint.json"), nil)
+	done := make(chan struct{})
+	ch := make(chan QueryResult)
+	var wg sync.WaitGroup
+	wg.Add(len(results))
+	go resultWriter([]ResultSink{csvSink, jsonl}, ch, summary, tracker, 0, &wg, func(error) {}, done)
+	for i, r := range results {
+		tracker.dispatched(int64(i))
+		r.offset = int64(i)
+		ch <- r
+	}
+	close(ch)
+	<-done
+
+	rows := readJSONL(t, filepath.Join(dir, "output.jsonl"))
+	require.Len(t, rows, 2)
+	assert.Equal(t, "run-1", rows[0].RunID)
+	assert.Equal(t, 1, rows[0].Number)
+	assert.Equal(t, uint64(3), rows[0].SourceMetrics.ProfileEvents["SelectedRows"])
+	assert.Equal(t, []comparedRow{{Target: "target2", ReplayDurationMs: 6, ResultRows: 1}}, rows[0].Compared)
+	assert.Equal(t, 2, rows[1].Number)
+	assert.Equal(t, "timeout", rows[1].Error)
+
+	// the final checkpoint records the size of every file sink
+	c, err := loadCheckpoint(filepath.Join(dir, "checkpoint.json"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, c.Results)
+	for _, name := range []string{"output.csv", "output.jsonl"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, info.Size(), c.SinkBytes[name], name)
+	}
+
+	// resuming drops rows written after the checkpoint
+	firstRow, err := json.Marshal(rows[0])
+	require.NoError(t, err)
+	resumed, err := openJSONLSink(filepath.Join(dir, "output.jsonl"), &replayCheckpoint{SinkBytes: map[string]int64{"output.jsonl": int64(len(firstRow) + 1)}}, "run-1")
+	require.NoError(t, err)
+	require.NoError(t, resumed.Close())
+	assert.Len(t, readJSONL(t, filepath.Join(dir, "output.jsonl")), 1)
+
+	// a sink the resumed run didn't write to can't be resumed
+	_, err = openJSONLSink(filepath.Join(dir, "output.jsonl"), &replayCheckpoint{SinkBytes: map[string]int64{}}, "run-1")
+	assert.Error(t, err)
+}
+
+// failingSink fails every write once fails is reached
+type failingSink struct {
+	writes    int
+	failAt    int
+	failFlush bool
+	closed    bool
+}
+
+func (s *failingSink) Write(number int, r QueryResult) error {
+	s.writes++
+	if s.writes >= s.failAt {
+		return errors.New("connection reset")
+	}
+	return nil
+}
+
+func (s *failingSink) Flush() error {
+	if s.failFlush {
+		return errors.New("no space left on device")
+	}
+	return nil
+}
+
+func (s *failingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestResultWriterSinkFailures(t *testing.T) {
+	run := func(sinks []ResultSink, n int) (*summaryCollector, error) {
+		summary := newSummaryCollector()
+		done := make(chan struct{})
+		ch := make(chan QueryResult)
+		var (
+			wg    sync.WaitGroup
+			cause error
+		)
+		wg.Add(n)
+		go resultWriter(sinks, ch, summary, nil, 0, &wg, func(err error) { cause = err }, done)
+		for i := 0; i < n; i++ {
+			ch <- QueryResult{queryKind: "Select", query: "SELECT 1", settingsSet: "default"}
+		}
+		close(ch)
+		<-done
+		wg.Wait()
+		return summary, cause
+	}
+
+	// a failing optional sink is dropped and the replay goes on
+	primary := &failingSink{failAt: 100}
+	optional := &failingSink{failAt: 2}
+	summary, cause := run([]ResultSink{primary, optional}, 4)
+	assert.NoError(t, cause)
+	assert.Equal(t, 4, primary.writes)
+	assert.Equal(t, 2, optional.writes)
+	assert.True(t, optional.closed)
+	assert.Equal(t, 4, summary.summary().Count)
+
+	// output.csv failing stops the replay, the results left are only drained
+	primary = &failingSink{failAt: 2}
+	summary, cause = run([]ResultSink{primary}, 4)
+	assert.ErrorContains(t, cause, "writing output.csv: connection reset")
+	assert.Equal(t, 2, primary.writes)
+	assert.Equal(t, 1, summary.summary().Count)
+	assert.True(t, primary.closed)
+
+	// so does output.csv failing to flush at the end
+	primary = &failingSink{failAt: 100, failFlush: true}
+	_, cause = run([]ResultSink{primary}, 2)
+	assert.ErrorContains(t, cause, "saving results: no space left on device")
+}
+
+func TestResumeAfterDroppedSink(t *testing.T) {
+	dir := t.TempDir()
+	opts := &ReplayOptions{RunDir: dir, RunID: "run-1", Sinks: []string{"jsonl"}}
+	sinks, err := openSinks(context.Background(), opts, nil)
+	require.NoError(t, err)
+	require.Len(t, sinks, 2)
+	// output.jsonl breaks, the final checkpoint fails to flush it
+	sinks[1].(*jsonlSink).file.Close()
+
+	tracker := newCheckpointTracker(filepath.Join(dir, "checkpoint.json"), nil)
+	done := make(chan struct{})
+	ch := make(chan QueryResult)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go resultWriter(sinks, ch, newSummaryCollector(), tracker, 0, &wg, func(error) {}, done)
+	tracker.dispatched(0)
+	ch <- QueryResult{queryKind: "Select", query: "SELECT 1", settingsSet: "default"}
+	close(ch)
+	<-done
+
+	c, err := loadCheckpoint(filepath.Join(dir, "checkpoint.json"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, c.Results)
+	assert.Equal(t, []string{"jsonl"}, c.DroppedSinks)
+	assert.NotContains(t, c.SinkBytes, "output.jsonl")
+
+	// the resumed replay goes on without the dropped sink
+	resumed, err := openSinks(context.Background(), opts, c)
+	require.NoError(t, err)
+	require.Len(t, resumed, 1)
+	require.NoError(t, resumed[0].Close())
+	assert.Equal(t, []string{"jsonl"}, newCheckpointTracker(filepath.Join(dir, "checkpoint.json"), c).checkpoint(1, nil).DroppedSinks)
+}
+
+func TestResultRowValuesMatchSchema(t *testing.T) {
+	columns := regexp.MustCompile(`(?m)^\s+([a-z_]+) [A-Z]`).FindAllStringSubmatch(clickhouseResultsSchema("replay_results"), -1)
+	row := newResultRow("run-1", 1, QueryResult{compared: []comparedReplay{{}}})
+	assert.Len(t, row.values(), len(columns))
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"replay_results", "`replay_results`"},
+		{"benchmarks.replay_results", "`benchmarks`.`replay_results`"},
+		{"a`b", "`a\\`b`"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, quoteIdentifier(tt.name))
+	}
+	assert.True(t, strings.Contains(clickhouseRunsSchema("db.results"), "`db`.`results_runs`"))
+}
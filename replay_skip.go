@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// queryFilter is an entry of a skip or allow file. Entries match query
+// shapes: every query sharing a normalized_query_hash with a matching
+// query is skipped or allowed.
+type queryFilter struct {
+	// kind is hash, regex, normalized or, for entries without a prefix,
+	// text which matches queries containing the entry verbatim
+	kind  string
+	value string
+	hash  uint64
+}
+
+var queryFilterKinds = []string{"hash", "regex", "normalized"}
+
+// parseQueryFilter parses a hash:, regex: or normalized: entry, anything
+// else is matched as text
+func parseQueryFilter(entry string) (queryFilter, error) {
+	kind, value, ok := strings.Cut(entry, ":")
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if !ok || !includes(queryFilterKinds, kind) {
+		return queryFilter{kind: "text", value: entry}, nil
+	}
+	f := queryFilter{kind: kind, value: strings.TrimSpace(value)}
+	if f.value == "" {
+		return f, fmt.Errorf("empty %s entry", kind)
+	}
+	switch kind {
+	case "hash":
+		hash, err := strconv.ParseUint(f.value, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid hash entry '%s', expected a normalized_query_hash", f.value)
+		}
+		f.hash = hash
+	case "regex":
+		// the regex is evaluated by ClickHouse's re2, Go's regexp accepts the same syntax
+		if _, err := regexp.Compile(f.value); err != nil {
+			return f, fmt.Errorf("invalid regex entry '%s': %v", f.value, err)
+		}
+	}
+	return f, nil
+}
+
+// loadQueryFilters reads a skip or allow file, entries are separated by
+// semicolons
+func loadQueryFilters(file string) ([]queryFilter, error) {
+	entries, err := loadSkipQueries(file)
+	if err != nil {
+		return nil, err
+	}
+	var filters []queryFilter
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		f, err := parseQueryFilter(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+func loadSkipQueries(file string) ([]string, error) {
+	var skipQueries []string
+	f, err := os.Open(file)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		// Split on semicolons instead of newlines
+		for i := 0; i < len(data); i++ {
+			if data[i] == ';' {
+				return i + 1, data[:i], nil
+			}
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		query := scanner.Text()
+		query = strings.TrimSpace(query)
+		query = strings.ReplaceAll(query, "\n", " ")
+		skipQueries = append(skipQueries, query)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return skipQueries, nil
+}
+
+// buildQueryLogQuery builds the query finding the normalized query hashes
+// of the filters that need the query log, hash entries don't. Entry values
+// are passed as query parameters so they need no escaping.
+func buildQueryLogQuery(filters []queryFilter) (string, []any) {
+	var (
+		predicates []string
+		params     []any
+	)
+	for _, f := range filters {
+		name := fmt.Sprintf("filter_%d", len(params))
+		switch f.kind {
+		case "hash":
+			continue
+		case "regex":
+			predicates = append(predicates, "match(query, {"+name+":String})")
+		case "normalized":
+			predicates = append(predicates, "normalized_query_hash = normalizedQueryHash({"+name+":String})")
+		default:
+			predicates = append(predicates, "position(query, {"+name+":String}) > 0")
+		}
+		params = append(params, clickhouse.Named(name, f.value))
+	}
+	if len(predicates) == 0 {
+		return "", nil
+	}
+
+	query := `
+select distinct normalized_query_hash
+from clusterAllReplicas({cluster:String}, system.query_log)
+where type = 2 and is_initial_query = 1 and query_kind in {kinds:Array(String)}
+and query_start_time >= {start:String} and query_start_time <= {stop:String}
+and (` + strings.Join(predicates, "\n\tor ") + `)
+order by normalized_query_hash
+`
+
+	log.Info("Query Log Query", query)
+	return query, params
+}
+
+// resolveQueryFilters returns the normalized query hashes the entries of a
+// skip or allow file match within the capture window, looking at the query
+// log of every replica of the source cluster
+func resolveQueryFilters(ctx context.Context, opts *ReplayOptions, file string) ([]uint64, error) {
+	filters, err := loadQueryFilters(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []uint64
+	for _, f := range filters {
+		if f.kind == "hash" {
+			hashes = append(hashes, f.hash)
+		}
+	}
+
+	query, params := buildQueryLogQuery(filters)
+	if query == "" {
+		return hashes, nil
+	}
+	params = append([]any{
+		clickhouse.Named("cluster", opts.Cluster),
+		clickhouse.Named("kinds", arrayParam(opts.Kinds)),
+		clickhouse.Named("start", opts.Start.Format("2006-01-02 15:04:05")),
+		clickhouse.Named("stop", opts.Stop.Format("2006-01-02 15:04:05")),
+	}, params...)
+	rows, err := opts.FromConn.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("resolving entries of %s: %v", file, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash uint64
+		if err := rows.Scan(&hash); err != nil {
+			return nil, fmt.Errorf("resolving entries of %s: %v", file, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("resolving entries of %s: %v", file, err)
+	}
+	return hashes, nil
+}
+
+// hashList formats hashes for an in (...) predicate
+func hashList(hashes []uint64) string {
+	strs := make([]string, 0, len(hashes))
+	for _, h := range hashes {
+		strs = append(strs, strconv.FormatUint(h, 10))
+	}
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// worstRegressionsLimit is the number of query shapes listed as the worst
+// regressions at the end of a replay
+const worstRegressionsLimit = 10
+
+type DurationStats struct {
+	P50 uint64 `json:"p50_ms"`
+	P90 uint64 `json:"p90_ms"`
+	P95 uint64 `json:"p95_ms"`
+	P99 uint64 `json:"p99_ms"`
+	Max uint64 `json:"max_ms"`
+}
+
+type QueryShapeSummary struct {
+	SettingsSet         string        `json:"settings_set"`
+	NormalizedQueryHash uint64        `json:"normalized_query_hash"`
+	ExampleQuery        string        `json:"example_query"`
+	Count               int           `json:"count"`
+	Errors              int           `json:"errors"`
+	ErrorRate           float64       `json:"error_rate"`
+	Original            DurationStats `json:"original"`
+	Replay              DurationStats `json:"replay"`
+	// Slowdown is the ratio of the replay p50 to the original p50
+	Slowdown float64 `json:"slowdown"`
+}
+
+// TargetComparison compares an additional target of an A/B replay with
+// the first target
+type TargetComparison struct {
+	Target    string        `json:"target"`
+	Errors    int           `json:"errors"`
+	ErrorRate float64       `json:"error_rate"`
+	Replay    DurationStats `json:"replay"`
+	// MedianRatio and P95Ratio summarize the per-query ratio of the
+	// target's duration to the first target's, over queries neither failed
+	MedianRatio float64 `json:"median_ratio"`
+	P95Ratio    float64 `json:"p95_ratio"`
+}
+
+// StageSummary reports the throughput reached in a load stage of a
+// closed-loop replay. Seconds is how long the stage ran, from the start of
+// its first query to the end of its last one, which may run past the
+// stage's duration.
+type StageSummary struct {
+	SettingsSet string        `json:"settings_set"`
+	Stage       int           `json:"stage"`
+	Users       int           `json:"users"`
+	Seconds     float64       `json:"seconds"`
+	Count       int           `json:"count"`
+	Errors      int           `json:"errors"`
+	ErrorRate   float64       `json:"error_rate"`
+	QPS         float64       `json:"qps"`
+	Replay      DurationStats `json:"replay"`
+}
+
+type ReplaySummary struct {
+	Count            int                 `json:"count"`
+	Errors           int                 `json:"errors"`
+	ErrorRate        float64             `json:"error_rate"`
+	Original         DurationStats       `json:"original"`
+	Replay           DurationStats       `json:"replay"`
+	Shapes           []QueryShapeSummary `json:"shapes"`
+	WorstRegressions []QueryShapeSummary `json:"worst_regressions"`
+	Targets          []TargetComparison  `json:"targets,omitempty"`
+	Stages           []StageSummary      `json:"stages,omitempty"`
+	// Rejected counts the errors of queries read-only mode didn't run
+	Rejected int `json:"rejected,omitempty"`
+}
+
+type shapeSamples struct {
+	exampleQuery string
+	errors       int
+	original     []uint64
+	replay       []uint64
+}
+
+// replaySamples accumulates the replays of a compare target or load stage
+type replaySamples struct {
+	count  int
+	errors int
+	replay []uint64
+	ratios []float64
+	// started and ended bound the replays of a load stage
+	started time.Time
+	ended   time.Time
+}
+
+type stageKey struct {
+	settingsSet string
+	stage       int
+}
+
+type shapeKey struct {
+	settingsSet         string
+	normalizedQueryHash uint64
+}
+
+// summaryCollector accumulates query results grouped by settings set and
+// normalized query hash. Durations of errored queries are left out of the latency
+// statistics since failures usually return much faster than the query would.
+type summaryCollector struct {
+	shapes  map[shapeKey]*shapeSamples
+	targets []*replaySamples
+	// stages configures the load stages of a closed-loop replay
+	stages       []LoadStage
+	stageSamples map[stageKey]*replaySamples
+	rejected     int
+}
+
+func newSummaryCollector() *summaryCollector {
+	return &summaryCollector{
+		shapes:       make(map[shapeKey]*shapeSamples),
+		stageSamples: make(map[stageKey]*replaySamples),
+	}
+}
+
+func (c *summaryCollector) add(r QueryResult) {
+	if r.stage > 0 {
+		key := stageKey{settingsSet: r.settingsSet, stage: r.stage}
+		stage, ok := c.stageSamples[key]
+		if !ok {
+			stage = &replaySamples{}
+			c.stageSamples[key] = stage
+		}
+		stage.count++
+		if !r.replayStartTime.IsZero() {
+			end := r.replayStartTime.Add(time.Duration(r.replayDurationMs) * time.Millisecond)
+			if stage.started.IsZero() || r.replayStartTime.Before(stage.started) {
+				stage.started = r.replayStartTime
+			}
+			if end.After(stage.ended) {
+				stage.ended = end
+			}
+		}
+		if r.queryErrored {
+			stage.errors++
+		} else {
+			stage.replay = append(stage.replay, r.replayDurationMs)
+		}
+	}
+	for i, compared := range r.compared {
+		if i == len(c.targets) {
+			c.targets = append(c.targets, &replaySamples{})
+		}
+		target := c.targets[i]
+		target.count++
+		if compared.queryErrored {
+			target.errors++
+			continue
+		}
+		target.replay = append(target.replay, compared.replayDurationMs)
+		if !r.queryErrored {
+			target.ratios = append(target.ratios, slowdown(r.replayDurationMs, compared.replayDurationMs))
+		}
+	}
+
+	key := shapeKey{settingsSet: r.settingsSet, normalizedQueryHash: r.normalizedQueryHash}
+	shape, ok := c.shapes[key]
+	if !ok {
+		shape = &shapeSamples{exampleQuery: r.query}
+		c.shapes[key] = shape
+	}
+	if r.queryErrored {
+		shape.errors++
+		if strings.HasPrefix(r.errorStr, readOnlyRejection) {
+			c.rejected++
+		}
+		return
+	}
+	shape.original = append(shape.original, r.originalDurationMs)
+	shape.replay = append(shape.replay, r.replayDurationMs)
+}
+
+func (c *summaryCollector) summary() ReplaySummary {
+	var (
+		s        ReplaySummary
+		original []uint64
+		replay   []uint64
+	)
+	for key, shape := range c.shapes {
+		count := len(shape.replay) + shape.errors
+		shapeSummary := QueryShapeSummary{
+			SettingsSet:         key.settingsSet,
+			NormalizedQueryHash: key.normalizedQueryHash,
+			ExampleQuery:        shape.exampleQuery,
+			Count:               count,
+			Errors:              shape.errors,
+			ErrorRate:           float64(shape.errors) / float64(count),
+			Original:            durationStats(shape.original),
+			Replay:              durationStats(shape.replay),
+		}
+		shapeSummary.Slowdown = slowdown(shapeSummary.Original.P50, shapeSummary.Replay.P50)
+		s.Shapes = append(s.Shapes, shapeSummary)
+
+		s.Count += count
+		s.Errors += shape.errors
+		original = append(original, shape.original...)
+		replay = append(replay, shape.replay...)
+	}
+	if s.Count > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Count)
+	}
+	s.Original = durationStats(original)
+	s.Replay = durationStats(replay)
+	s.Rejected = c.rejected
+
+	sort.Slice(s.Shapes, func(i, j int) bool {
+		if s.Shapes[i].Count != s.Shapes[j].Count {
+			return s.Shapes[i].Count > s.Shapes[j].Count
+		}
+		if s.Shapes[i].SettingsSet != s.Shapes[j].SettingsSet {
+			return s.Shapes[i].SettingsSet < s.Shapes[j].SettingsSet
+		}
+		return s.Shapes[i].NormalizedQueryHash < s.Shapes[j].NormalizedQueryHash
+	})
+
+	var regressions []QueryShapeSummary
+	for _, shape := range s.Shapes {
+		if shape.Slowdown > 1 {
+			regressions = append(regressions, shape)
+		}
+	}
+	sort.SliceStable(regressions, func(i, j int) bool {
+		return regressions[i].Slowdown > regressions[j].Slowdown
+	})
+	if len(regressions) > worstRegressionsLimit {
+		regressions = regressions[:worstRegressionsLimit]
+	}
+	s.WorstRegressions = regressions
+
+	for i, target := range c.targets {
+		sort.Float64s(target.ratios)
+		s.Targets = append(s.Targets, TargetComparison{
+			Target:      compareTargetName(i),
+			Errors:      target.errors,
+			ErrorRate:   float64(target.errors) / float64(target.count),
+			Replay:      durationStats(target.replay),
+			MedianRatio: percentile(target.ratios, 50),
+			P95Ratio:    percentile(target.ratios, 95),
+		})
+	}
+
+	for key, stage := range c.stageSamples {
+		stageSummary := StageSummary{
+			SettingsSet: key.settingsSet,
+			Stage:       key.stage,
+			Count:       stage.count,
+			Errors:      stage.errors,
+			ErrorRate:   float64(stage.errors) / float64(stage.count),
+			Replay:      durationStats(stage.replay),
+		}
+		if key.stage <= len(c.stages) {
+			config := c.stages[key.stage-1]
+			stageSummary.Users = config.Users
+			stageSummary.Seconds = config.Duration.Seconds()
+		}
+		if elapsed := stage.ended.Sub(stage.started); elapsed > 0 {
+			stageSummary.Seconds = elapsed.Seconds()
+		}
+		if stageSummary.Seconds > 0 {
+			stageSummary.QPS = float64(stage.count) / stageSummary.Seconds
+		}
+		s.Stages = append(s.Stages, stageSummary)
+	}
+	sort.Slice(s.Stages, func(i, j int) bool {
+		if s.Stages[i].SettingsSet != s.Stages[j].SettingsSet {
+			return s.Stages[i].SettingsSet < s.Stages[j].SettingsSet
+		}
+		return s.Stages[i].Stage < s.Stages[j].Stage
+	})
+	return s
+}
+
+func durationStats(durations []uint64) DurationStats {
+	sorted := make([]uint64, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return DurationStats{
+		P50: percentile(sorted, 50),
+		P90: percentile(sorted, 90),
+		P95: percentile(sorted, 95),
+		P99: percentile(sorted, 99),
+		Max: percentile(sorted, 100),
+	}
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations or ratios
+func percentile[T uint64 | float64](sorted []T, p float64) T {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// slowdown compares two durations, treating anything below a millisecond
+// as a millisecond so that very fast queries don't produce infinite ratios
+func slowdown(originalMs, replayMs uint64) float64 {
+	return float64(max(replayMs, 1)) / float64(max(originalMs, 1))
+}
+
+func printSummary(w io.Writer, s ReplaySummary) {
+	fmt.Fprintf(w, "\nReplayed %d queries across %d query shapes, %d errors (%.2f%%)\n", s.Count, len(s.Shapes), s.Errors, s.ErrorRate*100)
+	if s.Rejected > 0 {
+		fmt.Fprintf(w, "%d of the errors are statements rejected by read-only mode, see the error column of output.csv\n", s.Rejected)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tp50 ms\tp90 ms\tp99 ms\tmax ms")
+	fmt.Fprintf(tw, "original\t%d\t%d\t%d\t%d\n", s.Original.P50, s.Original.P90, s.Original.P99, s.Original.Max)
+	fmt.Fprintf(tw, "replay\t%d\t%d\t%d\t%d\n", s.Replay.P50, s.Replay.P90, s.Replay.P99, s.Replay.Max)
+	tw.Flush()
+
+	if len(s.Targets) > 0 {
+		fmt.Fprintln(w, "\nCompared to target1:")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "target\terror rate\tp50 ms\tp90 ms\tp99 ms\tmax ms\tmedian ratio\tp95 ratio")
+		for _, t := range s.Targets {
+			fmt.Fprintf(tw, "%s\t%.2f%%\t%d\t%d\t%d\t%d\t%.2fx\t%.2fx\n",
+				t.Target, t.ErrorRate*100, t.Replay.P50, t.Replay.P90, t.Replay.P99, t.Replay.Max, t.MedianRatio, t.P95Ratio)
+		}
+		tw.Flush()
+	}
+
+	if len(s.Stages) > 0 {
+		fmt.Fprintln(w, "\nClosed-loop stages:")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "settings set\tstage\tusers\tqueries\tqps\terror rate\tp50 ms\tp95 ms\tp99 ms")
+		for _, stage := range s.Stages {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\t%.2f%%\t%d\t%d\t%d\n",
+				stage.SettingsSet, stage.Stage, stage.Users, stage.Count, stage.QPS, stage.ErrorRate*100,
+				stage.Replay.P50, stage.Replay.P95, stage.Replay.P99)
+		}
+		tw.Flush()
+	}
+
+	if len(s.WorstRegressions) == 0 {
+		fmt.Fprintln(w, "\nNo query shape got slower")
+		return
+	}
+	fmt.Fprintln(w, "\nWorst regressions:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "settings set\tnormalized_query_hash\tcount\terror rate\toriginal p50 ms\treplay p50 ms\treplay p99 ms\tslowdown\tquery")
+	for _, shape := range s.WorstRegressions {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f%%\t%d\t%d\t%d\t%.2fx\t%s\n",
+			shape.SettingsSet, shape.NormalizedQueryHash, shape.Count, shape.ErrorRate*100,
+			shape.Original.P50, shape.Replay.P50, shape.Replay.P99, shape.Slowdown,
+			truncateQuery(shape.ExampleQuery, 80))
+	}
+	tw.Flush()
+}
+
+// truncateQuery shortens a query to a single line of at most n characters
+func truncateQuery(query string, n int) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > n {
+		return query[:n-3] + "..."
+	}
+	return query
+}
+
+func writeSummary(path string, s ReplaySummary) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding summary: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing summary: %v", err)
+	}
+	return nil
+}
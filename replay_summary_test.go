@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	assert.Equal(t, uint64(5), percentile(sorted, 50))
+	assert.Equal(t, uint64(9), percentile(sorted, 90))
+	assert.Equal(t, uint64(10), percentile(sorted, 99))
+	assert.Equal(t, uint64(10), percentile(sorted, 100))
+	assert.Equal(t, uint64(1), percentile(sorted, 0))
+	assert.Equal(t, uint64(0), percentile([]uint64(nil), 50))
+}
+
+func TestSummaryCollector(t *testing.T) {
+	c := newSummaryCollector()
+	for _, d := range []uint64{10, 20, 30, 40} {
+		c.add(QueryResult{normalizedQueryHash: 1, query: "SELECT 1", originalDurationMs: d, replayDurationMs: d * 2})
+	}
+	c.add(QueryResult{normalizedQueryHash: 1, query: "SELECT 1", queryErrored: true, replayDurationMs: 1})
+	c.add(QueryResult{normalizedQueryHash: 2, query: "SELECT 2", originalDurationMs: 100, replayDurationMs: 50})
+
+	s := c.summary()
+	assert.Equal(t, 6, s.Count)
+	assert.Equal(t, 1, s.Errors)
+	assert.Len(t, s.Shapes, 2)
+
+	shape := s.Shapes[0]
+	assert.Equal(t, uint64(1), shape.NormalizedQueryHash)
+	assert.Equal(t, 5, shape.Count)
+	assert.Equal(t, 1, shape.Errors)
+	assert.InDelta(t, 0.2, shape.ErrorRate, 1e-9)
+	assert.Equal(t, DurationStats{P50: 20, P90: 40, P95: 40, P99: 40, Max: 40}, shape.Original)
+	assert.Equal(t, DurationStats{P50: 40, P90: 80, P95: 80, P99: 80, Max: 80}, shape.Replay)
+	assert.InDelta(t, 2.0, shape.Slowdown, 1e-9)
+
+	// only the shape that got slower is a regression
+	assert.Len(t, s.WorstRegressions, 1)
+	assert.Equal(t, uint64(1), s.WorstRegressions[0].NormalizedQueryHash)
+}
+
+func TestSummaryCollectorRejected(t *testing.T) {
+	c := newSummaryCollector()
+	c.add(QueryResult{normalizedQueryHash: 1, queryErrored: true, errorStr: checkReadOnly("ALTER TABLE t DELETE WHERE 1").Error()})
+	c.add(QueryResult{normalizedQueryHash: 2, queryErrored: true, errorStr: "timeout"})
+
+	s := c.summary()
+	assert.Equal(t, 2, s.Errors)
+	assert.Equal(t, 1, s.Rejected)
+}
+
+func TestSummaryCollectorTargets(t *testing.T) {
+	c := newSummaryCollector()
+	c.add(QueryResult{replayDurationMs: 10, compared: []comparedReplay{{replayDurationMs: 20}}})
+	c.add(QueryResult{replayDurationMs: 10, compared: []comparedReplay{{replayDurationMs: 5}}})
+	c.add(QueryResult{replayDurationMs: 10, compared: []comparedReplay{{replayDurationMs: 30}}})
+	// errored on the first target, so it has no ratio
+	c.add(QueryResult{queryErrored: true, compared: []comparedReplay{{replayDurationMs: 40}}})
+	c.add(QueryResult{replayDurationMs: 10, compared: []comparedReplay{{queryErrored: true}}})
+
+	s := c.summary()
+	require.Len(t, s.Targets, 1)
+	target := s.Targets[0]
+	assert.Equal(t, "target2", target.Target)
+	assert.Equal(t, 1, target.Errors)
+	assert.InDelta(t, 0.2, target.ErrorRate, 1e-9)
+	assert.Equal(t, DurationStats{P50: 20, P90: 40, P95: 40, P99: 40, Max: 40}, target.Replay)
+	assert.InDelta(t, 2.0, target.MedianRatio, 1e-9)
+	assert.InDelta(t, 3.0, target.P95Ratio, 1e-9)
+}
+
+func TestSummaryCollectorStages(t *testing.T) {
+	c := newSummaryCollector()
+	c.stages = []LoadStage{{Duration: 10 * time.Second, Users: 5}, {Duration: 20 * time.Second, Users: 10}}
+	// the queries of stage 1 run back to back past its 10s, for 12.5s
+	start := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 50; i++ {
+		c.add(QueryResult{settingsSet: "default", stage: 1, replayStartTime: start.Add(time.Duration(i) * 250 * time.Millisecond), replayDurationMs: 250})
+	}
+	// without replay start times the stage's duration is used
+	for i := 0; i < 100; i++ {
+		c.add(QueryResult{settingsSet: "default", stage: 2, replayDurationMs: 20, queryErrored: i%10 == 0})
+	}
+	// open-loop results have no stage
+	c.add(QueryResult{settingsSet: "default", replayDurationMs: 5})
+
+	s := c.summary()
+	require.Len(t, s.Stages, 2)
+	assert.Equal(t, StageSummary{
+		SettingsSet: "default",
+		Stage:       1,
+		Users:       5,
+		Seconds:     12.5,
+		Count:       50,
+		QPS:         4,
+		Replay:      DurationStats{P50: 250, P90: 250, P95: 250, P99: 250, Max: 250},
+	}, s.Stages[0])
+	assert.Equal(t, 2, s.Stages[1].Stage)
+	assert.Equal(t, 10, s.Stages[1].Errors)
+	assert.InDelta(t, 5.0, s.Stages[1].QPS, 1e-9)
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"testing"
+	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoadSkipQueries(t *testing.T) {
@@ -38,58 +41,211 @@ func TestLoadSkipQueries(t *testing.T) {
 	}
 }
 
+func TestParseQueryFilter(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    queryFilter
+		wantErr bool
+	}{
+		{entry: "SELECT * FROM table1", want: queryFilter{kind: "text", value: "SELECT * FROM table1"}},
+		{entry: "SELECT 'a:b'", want: queryFilter{kind: "text", value: "SELECT 'a:b'"}},
+		{entry: "hash: 123", want: queryFilter{kind: "hash", value: "123", hash: 123}},
+		{entry: "hash:abc", wantErr: true},
+		{entry: "regex:^SELECT .* FROM events", want: queryFilter{kind: "regex", value: "^SELECT .* FROM events"}},
+		{entry: "regex:(", wantErr: true},
+		{entry: "normalized:SELECT count() FROM t WHERE id = 1", want: queryFilter{kind: "normalized", value: "SELECT count() FROM t WHERE id = 1"}},
+		{entry: "normalized:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry, func(t *testing.T) {
+			got, err := parseQueryFilter(tt.entry)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
 func TestBuildQueryLogQuery(t *testing.T) {
+	filters := []queryFilter{
+		{kind: "text", value: "SELECT * FROM table1 where is = 'something' and name like '50%_a\\b'"},
+		{kind: "hash", value: "42", hash: 42},
+		{kind: "regex", value: "^SELECT .* FROM events"},
+		{kind: "normalized", value: "SELECT 1"},
+	}
+	query, params := buildQueryLogQuery(filters)
+	assert.Equal(t, `
+select distinct normalized_query_hash
+from clusterAllReplicas({cluster:String}, system.query_log)
+where type = 2 and is_initial_query = 1 and query_kind in {kinds:Array(String)}
+and query_start_time >= {start:String} and query_start_time <= {stop:String}
+and (position(query, {filter_0:String}) > 0
+	or match(query, {filter_1:String})
+	or normalized_query_hash = normalizedQueryHash({filter_2:String}))
+order by normalized_query_hash
+`, query)
+	// values are passed verbatim as parameters instead of being escaped
+	assert.Equal(t, []any{
+		clickhouse.Named("filter_0", filters[0].value),
+		clickhouse.Named("filter_1", filters[2].value),
+		clickhouse.Named("filter_2", filters[3].value),
+	}, params)
+
+	// hash entries don't need the query log
+	query, params = buildQueryLogQuery([]queryFilter{{kind: "hash", value: "42", hash: 42}})
+	assert.Empty(t, query)
+	assert.Empty(t, params)
+}
+
+func TestLoadQueryFilters(t *testing.T) {
+	filters, err := loadQueryFilters("testdata/query_filters.sql")
+	require.NoError(t, err)
+	assert.Equal(t, []queryFilter{
+		{kind: "text", value: "SELECT * FROM table1"},
+		{kind: "hash", value: "1234567890", hash: 1234567890},
+		{kind: "regex", value: "FROM events WHERE team_id = \\d+"},
+		{kind: "normalized", value: "SELECT count() FROM persons WHERE id = 1"},
+	}, filters)
+}
+
+func TestReplayClockVirtualTime(t *testing.T) {
+	origin := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	started := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
 	tests := []struct {
-		name        string
-		skipQueries []string
-		want        string
-		wantErr     bool
+		name    string
+		speed   float64
+		elapsed time.Duration
+		want    time.Time
 	}{
 		{
-			name:        "valid queries",
-			skipQueries: []string{"SELECT * FROM table1", "SELECT * FROM table2;"},
-			want: `
-select normalized_query_hash from system.query_log
-where type = 2 and is_initial_query = 1 and query_kind = 'Select'
-and query_start_time >= {start:String} and query_start_time <= {stop:String}
-and (query like '%SELECT * FROM table1%' or query like '%SELECT * FROM table2%')
-group by normalized_query_hash
-`,
-			wantErr: false,
+			name:    "real time",
+			speed:   1,
+			elapsed: time.Minute,
+			want:    origin.Add(time.Minute),
 		},
 		{
-			name:        "valid queries with quotes",
-			skipQueries: []string{"SELECT * FROM table1 where is = 'something';", "SELECT * FROM table2 where foo = \"bar\""},
-			want: `
-select normalized_query_hash from system.query_log
-where type = 2 and is_initial_query = 1 and query_kind = 'Select'
-and query_start_time >= {start:String} and query_start_time <= {stop:String}
-and (query like '%SELECT * FROM table1 where is = \'something\'%' or query like '%SELECT * FROM table2 where foo = \"bar\"%')
-group by normalized_query_hash
-`,
-			wantErr: false,
+			name:    "ten times faster",
+			speed:   10,
+			elapsed: time.Minute,
+			want:    origin.Add(10 * time.Minute),
 		},
 		{
-			name:        "no queries",
-			skipQueries: []string{},
-			want: `
-select normalized_query_hash from system.query_log
-where type = 2 and is_initial_query = 1 and query_kind = 'Select'
-and query_start_time >= {start:String} and query_start_time <= {stop:String}
-
-group by normalized_query_hash
-`,
-			wantErr: false,
+			name:    "half speed",
+			speed:   0.5,
+			elapsed: time.Minute,
+			want:    origin.Add(30 * time.Second),
+		},
+		{
+			name:    "start of replay",
+			speed:   10,
+			elapsed: 0,
+			want:    origin,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := buildQueryLogQuery(tt.skipQueries)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("buildQueryLogQuery() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			assert.Equal(t, tt.want, got)
+			clock := newReplayClock(origin, started, tt.speed)
+			assert.Equal(t, tt.want, clock.virtualTime(started.Add(tt.elapsed)))
 		})
 	}
 }
+
+func TestQueryRecordRoundTrip(t *testing.T) {
+	q := Query{
+		queryKind:           "Select",
+		query:               "SELECT count(), \"a,b\" FROM events\nWHERE team_id = 2",
+		queryStartTime:      time.Date(2023, 10, 1, 12, 30, 0, 123456000, time.UTC),
+		queryDurationMs:     42,
+		normalizedQueryHash: 1234567890123456789,
+		sourceMetrics: QueryMetrics{
+			ReadRows:      1000,
+			ReadBytes:     64000,
+			MemoryUsage:   4096,
+			ProfileEvents: map[string]uint64{"SelectedMarks": 3, "SelectedParts": 2},
+		},
+	}
+	got, err := parseQueryRecord(queryRecord(q))
+	assert.NoError(t, err)
+	assert.Equal(t, q, got)
+
+	// older workload files have no source metrics columns
+	got, err = parseQueryRecord(queryRecord(q)[:5])
+	assert.NoError(t, err)
+	assert.Equal(t, QueryMetrics{}, got.sourceMetrics)
+
+	// and before that no normalized query hash column
+	got, err = parseQueryRecord(queryRecord(q)[:4])
+	assert.NoError(t, err)
+	assert.NotZero(t, got.normalizedQueryHash)
+
+	_, err = parseQueryRecord([]string{"Select", "SELECT 1"})
+	assert.Error(t, err)
+
+	_, err = parseQueryRecord([]string{"Select", "SELECT 1", "not a time", "1"})
+	assert.Error(t, err)
+}
+
+func TestBuildWorkloadQuery(t *testing.T) {
+	opts := &ReplayOptions{
+		Cluster: "posthog",
+		Kinds:   []string{"Select"},
+		Start:   time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC),
+		Stop:    time.Date(2023, 10, 2, 0, 0, 0, 0, time.UTC),
+	}
+
+	query, params := buildWorkloadQuery(opts, []uint64{1, 2}, nil)
+	assert.Equal(t, `
+		select query_kind, query, query_start_time_microseconds, query_duration_ms, normalized_query_hash,
+			any(read_rows) as source_read_rows, any(read_bytes) as source_read_bytes,
+			any(memory_usage) as source_memory_usage, any(mapFilter((k, v) -> has({profile_events:Array(String)}, k), ProfileEvents)) as source_profile_events
+		from clusterAllReplicas({cluster:String}, system.query_log)
+		where type = 2 and is_initial_query = 1 and query_kind in {kinds:Array(String)}
+		and (query_kind != 'Insert' or positionCaseInsensitive(query, 'select') > 0)
+		and query_start_time >= {start:String} and query_start_time <= {stop:String}
+		and normalized_query_hash not in (1, 2)
+		group by query, query_start_time_microseconds, query_duration_ms, query_kind, normalized_query_hash
+		order by query_start_time_microseconds asc
+		`, query)
+	assert.Equal(t, []any{
+		clickhouse.Named("cluster", "posthog"),
+		clickhouse.Named("kinds", "['Select']"),
+		clickhouse.Named("start", "2023-10-01 00:00:00"),
+		clickhouse.Named("stop", "2023-10-02 00:00:00"),
+		profileEventsParam(),
+	}, params)
+
+	// an allow list keeps only its shapes
+	query, _ = buildWorkloadQuery(opts, []uint64{2}, []uint64{1, 2})
+	assert.Contains(t, query, `
+		and normalized_query_hash in (1, 2)
+		and normalized_query_hash not in (2)
+		group by`)
+
+	opts.Sampling = WorkloadSampling{
+		SamplePercent: 12.5,
+		TopShapes:     50,
+		MaxPerShape:   20,
+		Users:         []string{"app"},
+		Databases:     []string{"posthog"},
+		Seed:          42,
+	}
+	query, params = buildWorkloadQuery(opts, nil, nil)
+	assert.Contains(t, query, "and user in {users:Array(String)}")
+	assert.Contains(t, query, "and current_database in {databases:Array(String)}")
+	assert.NotContains(t, query, "initial_user")
+	assert.Contains(t, query, "% 10000 < {sample:UInt64}")
+	assert.Contains(t, query, "limit {top_shapes:UInt64}")
+	assert.Contains(t, query, "limit {max_per_shape:UInt64} by normalized_query_hash")
+	assert.Contains(t, params, clickhouse.Named("users", "['app']"))
+	assert.Contains(t, params, clickhouse.Named("sample", "1250"))
+	assert.Contains(t, params, clickhouse.Named("top_shapes", "50"))
+	assert.Contains(t, params, clickhouse.Named("max_per_shape", "20"))
+	assert.Contains(t, params, clickhouse.Named("seed", "42"))
+
+	// the same options always produce the same query
+	again, _ := buildWorkloadQuery(opts, nil, nil)
+	assert.Equal(t, query, again)
+}
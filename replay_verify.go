@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// resultChecksum runs query on conn and returns the number of rows it
+// produced together with a hash of the result set. Row hashes are summed so
+// the checksum does not depend on the order rows come back in, which is not
+// guaranteed for queries without an ORDER BY.
+func resultChecksum(ctx context.Context, conn *sql.DB, query string) (uint64, uint64, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		rowCount uint64
+		checksum uint64
+		values   = make([]any, len(columns))
+		dest     = make([]any, len(columns))
+	)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return 0, 0, err
+		}
+		rowCount++
+		checksum += rowHash(values)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	return rowCount, checksum, nil
+}
+
+// rowHash returns a hash of a single result row
+func rowHash(values []any) uint64 {
+	h := fnv.New64a()
+	for _, v := range values {
+		writeValue(h, reflect.ValueOf(v))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// writeValue writes a canonical text form of v. Nullable and nested columns
+// are scanned into pointers, slices and maps, so these are walked rather
+// than printed with %v which would include pointer addresses and map order.
+func writeValue(w io.Writer, v reflect.Value) {
+	if !v.IsValid() {
+		fmt.Fprint(w, "NULL")
+		return
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		// source and target may be configured with different server timezones
+		fmt.Fprint(w, t.UTC().Format(time.RFC3339Nano))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			fmt.Fprint(w, "NULL")
+			return
+		}
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			fmt.Fprint(w, s.String())
+			return
+		}
+		writeValue(w, v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			fmt.Fprintf(w, "%x", v.Interface())
+			return
+		}
+		fmt.Fprint(w, "[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				fmt.Fprint(w, ",")
+			}
+			writeValue(w, v.Index(i))
+		}
+		fmt.Fprint(w, "]")
+	case reflect.Map:
+		entries := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			var entry strings.Builder
+			writeValue(&entry, iter.Key())
+			entry.WriteString(":")
+			writeValue(&entry, iter.Value())
+			entries = append(entries, entry.String())
+		}
+		sort.Strings(entries)
+		fmt.Fprint(w, "{"+strings.Join(entries, ",")+"}")
+	default:
+		fmt.Fprintf(w, "%v", v.Interface())
+	}
+}
+
+// verifyResult runs query on the source connection and compares its
+// result set with the one the target returned
+func verifyResult(ctx context.Context, sourceConn *sql.DB, query string, r *QueryResult) {
+	sourceRows, sourceHash, err := resultChecksum(ctx, sourceConn, query)
+	r.verified = true
+	if err != nil {
+		r.verifyErrorStr = err.Error()
+		return
+	}
+	r.sourceRowCount = sourceRows
+	r.sourceResultHash = sourceHash
+	if !r.queryErrored {
+		r.resultMismatch = r.rowCount != sourceRows || r.resultHash != sourceHash
+	}
+}
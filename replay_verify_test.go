@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowHash(t *testing.T) {
+	a, b := "a", "a"
+	ts := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+
+	// Nullable values are scanned into distinct pointers, only the value counts
+	assert.Equal(t, rowHash([]any{&a, uint64(1)}), rowHash([]any{&b, uint64(1)}))
+	// The same instant rendered in another server timezone
+	assert.Equal(t, rowHash([]any{ts}), rowHash([]any{ts.In(berlin)}))
+	assert.Equal(t,
+		rowHash([]any{map[string]uint64{"x": 1, "y": 2, "z": 3}}),
+		rowHash([]any{map[string]uint64{"z": 3, "y": 2, "x": 1}}))
+
+	assert.NotEqual(t, rowHash([]any{"a", "bc"}), rowHash([]any{"ab", "c"}))
+	assert.NotEqual(t, rowHash([]any{nil}), rowHash([]any{""}))
+	assert.NotEqual(t, rowHash([]any{[]string{"a", "b"}}), rowHash([]any{[]string{"b", "a"}}))
+}
@@ -0,0 +1,6 @@
+SELECT *
+FROM table1;
+hash:1234567890;
+regex:FROM events WHERE team_id = \d+;
+normalized:SELECT count()
+FROM persons WHERE id = 1;